@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -28,4 +29,9 @@ func main() {
 		}
 		fmt.Println(string(resp))
 	}
+	ret, err := servicebus.CallTyped[[]int, int](context.Background(), sender, "Add-Service.math.sum", ints)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(ret)
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/blacktear23/go-servicebus/servicebus"
@@ -16,24 +20,33 @@ func (*Calculator) IsBackground() bool {
 	return true
 }
 
-func (*Calculator) OnCall(req servicebus.Request, resp servicebus.Response) {
+func (*Calculator) OnCall(req servicebus.Request, resp servicebus.Response) error {
 	fmt.Println("Receive Message:", req.GetMessage())
 	var ints = []int{}
 	err := json.Unmarshal(req.GetMessage(), &ints)
 	if err != nil {
-		resp.SendString(fmt.Sprintf("%v", err))
-		return
+		return err
 	}
 	ret := 0
 	for _, v := range ints {
 		ret += v
 	}
 	fmt.Println("Send Result:", ret)
-	resp.SendString(fmt.Sprintf("%d", ret))
+	return resp.SendString(fmt.Sprintf("%d", ret))
 }
 
-func (*Calculator) OnMessage(req servicebus.Request) {
+func (*Calculator) OnMessage(req servicebus.Request) error {
 	fmt.Println(string(req.GetMessage()))
+	return nil
+}
+
+// sum is a typed service, request and response are JSON encoded
+func sum(ctx context.Context, ints []int) (int, error) {
+	ret := 0
+	for _, v := range ints {
+		ret += v
+	}
+	return ret, nil
 }
 
 func main() {
@@ -48,8 +61,15 @@ func main() {
 	}
 	server := config.CreateServer()
 	server.RegisterService("math", "add", &Calculator{})
+	servicebus.RegisterTypedService(server, "math", "sum", sum)
 	server.Start()
-	for {
-		time.Sleep(1 * time.Minute)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Shutdown:", err)
 	}
 }
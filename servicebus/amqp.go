@@ -1,58 +1,178 @@
 package servicebus
 
 import (
-	"crypto/md5"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
 )
 
 var (
-	ErrTimeout = errors.New("Timeout")
+	ErrTimeout          = errors.New("Timeout")
+	ErrConnectionClosed = errors.New("Connection closed")
 )
 
-// AMQPDriver is a basic AMQP client, provide basic operation to RabbitMQ
+const (
+	defaultChannelPoolSize = 4
+	defaultHeartbeat       = 10 * time.Second
+	defaultLocale          = "en_US"
+)
+
+// AMQPDriver is a basic AMQP client, provide basic operation to RabbitMQ.
+// Publish and RPC methods are safe for concurrent use, they use channels from
+// a pool so one channel is never used by two goroutines at the same time.
+// Queue declaring and consuming methods use the driver's own channel and
+// should be called from one goroutine.
 type AMQPDriver struct {
-	host    string
-	config  *Config
-	queue   amqp.Queue
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	// host is broker address for logs, it never contains password
+	host string
+	// endpoint is host[:port] or AMQP URI from Config
+	endpoint string
+	config   *Config
+	queue    amqp.Queue
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+
+	consumerTag string
+
+	// lock protect conn and pool when driver reconnect
+	lock sync.RWMutex
+	pool *channelPool
+
+	// replyLock protect reply queue and pending calls
+	replyLock    sync.Mutex
+	replyChannel *amqp.Channel
+	replyQueue   string
+	pending      map[string]*pendingCall
+}
+
+// pendingCall is a RPC request waiting for reply
+type pendingCall struct {
+	replyTo string
+	reply   chan []byte
 }
 
-func newAMQPDriver(host string, config *Config) *AMQPDriver {
+func newAMQPDriver(endpoint string, config *Config) *AMQPDriver {
+	host := endpoint
+	if isURI(endpoint) {
+		if uri, err := amqp.ParseURI(endpoint); err == nil {
+			host = net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port))
+		}
+	}
 	return &AMQPDriver{
-		host:   host,
-		config: config,
+		host:     host,
+		endpoint: endpoint,
+		config:   config,
+		pending:  make(map[string]*pendingCall),
 	}
 }
 
 // Dial connect to RabbitMQ server and then create a Channel via this connection
 func (d *AMQPDriver) Dial() error {
-	port := 5672
-	schema := "amqp"
-	if d.config.UseSSL {
-		port = 5671
-		schema = "amqps"
+	if (d.config.TLSConfig != nil || d.config.ExternalAuth) && !isTLSEndpoint(d.endpoint, d.config) {
+		// Config may not be validated, do not send credentials in plaintext
+		return fmt.Errorf("%w: TLSConfig and ExternalAuth require amqps, set UseSSL or use amqps URI for %q", ErrInvalidConfig, d.endpoint)
+	}
+	uri := d.uri()
+	dialConfig := amqp.Config{
+		Heartbeat: d.config.Heartbeat,
+		Vhost:     d.config.VHost,
+		Locale:    defaultLocale,
+	}
+	if dialConfig.Heartbeat == 0 {
+		// amqp.DialConfig use server's heartbeat for 0, keep amqp.Dial's
+		// default instead
+		dialConfig.Heartbeat = defaultHeartbeat
+	}
+	if d.config.DialTimeout > 0 {
+		dialConfig.Dial = amqp.DefaultDial(d.config.DialTimeout)
+	}
+	if d.config.TLSConfig != nil {
+		// amqp.DialConfig may set ServerName, do not modify shared config
+		dialConfig.TLSClientConfig = d.config.TLSConfig.Clone()
 	}
-	uri := fmt.Sprintf("%s://%s:%s@%s:%d", schema, d.config.User, d.config.Password, d.host, port)
-	conn, err := amqp.Dial(uri)
+	if d.config.ExternalAuth {
+		dialConfig.SASL = []amqp.Authentication{externalAuth{}}
+	}
+	conn, err := amqp.DialConfig(uri, dialConfig)
 	if err != nil {
 		return err
 	}
 	channel, err := conn.Channel()
 	if err != nil {
-		d.conn.Close()
+		conn.Close()
 		return err
 	}
+	d.lock.Lock()
 	d.conn = conn
 	d.channel = channel
+	d.pool = newChannelPool(conn, d.config.ChannelPoolSize)
+	d.lock.Unlock()
 	return nil
 }
 
+// uri return AMQP URI of driver's endpoint. Endpoint can be a full URI or
+// host[:port], user and password in URI are escaped.
+func (d *AMQPDriver) uri() string {
+	if isURI(d.endpoint) {
+		return d.endpoint
+	}
+	uri := amqp.URI{
+		Scheme:   "amqp",
+		Host:     d.endpoint,
+		Port:     5672,
+		Username: d.config.User,
+		Password: d.config.Password,
+		Vhost:    "/",
+	}
+	if d.config.UseSSL {
+		uri.Scheme = "amqps"
+		uri.Port = 5671
+	}
+	if d.config.Port > 0 {
+		uri.Port = d.config.Port
+	}
+	if host, port, err := net.SplitHostPort(d.endpoint); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			uri.Host = host
+			uri.Port = p
+		}
+	}
+	return uri.String()
+}
+
+func isURI(endpoint string) bool {
+	return strings.Contains(endpoint, "://")
+}
+
+// isTLSEndpoint report whether endpoint is connected by amqps
+func isTLSEndpoint(endpoint string, config *Config) bool {
+	if !isURI(endpoint) {
+		return config.UseSSL
+	}
+	uri, err := amqp.ParseURI(endpoint)
+	return err == nil && uri.Scheme == "amqps"
+}
+
+// externalAuth is SASL EXTERNAL mechanism, broker authenticate client by
+// TLS client certificate
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
 func (d *AMQPDriver) reopenChannel() error {
 	if d.channel != nil {
 		d.channel.Close()
@@ -68,6 +188,19 @@ func (d *AMQPDriver) reopenChannel() error {
 
 // Close close this connection
 func (d *AMQPDriver) Close() error {
+	d.replyLock.Lock()
+	if d.replyChannel != nil {
+		d.replyChannel.Close()
+		d.replyChannel = nil
+		d.replyQueue = ""
+	}
+	d.replyLock.Unlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.pool != nil {
+		d.pool.Close()
+		d.pool = nil
+	}
 	if d.channel != nil {
 		d.channel.Close()
 	}
@@ -77,6 +210,47 @@ func (d *AMQPDriver) Close() error {
 	return nil
 }
 
+// NotifyClose register a listener for connection close, receiver will be
+// closed immediately if driver is not connected
+func (d *AMQPDriver) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	d.lock.RLock()
+	conn := d.conn
+	d.lock.RUnlock()
+	if conn == nil {
+		close(receiver)
+		return receiver
+	}
+	return conn.NotifyClose(receiver)
+}
+
+// Publish publish message with a channel from channel pool
+func (d *AMQPDriver) Publish(exchange, key string, msg amqp.Publishing) error {
+	d.lock.RLock()
+	pool := d.pool
+	d.lock.RUnlock()
+	if pool == nil {
+		return ErrConnectionClosed
+	}
+	channel, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	err = channel.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg,
+	)
+	if err != nil {
+		// Channel is closed by server when publish failed, drop it
+		channel.Close()
+		return err
+	}
+	pool.Put(channel)
+	return nil
+}
+
 // DeclareQueue declare a queue to RabbitMQ server
 func (d *AMQPDriver) DeclareQueue(name string, rpc bool) (amqp.Queue, error) {
 	if rpc {
@@ -141,83 +315,270 @@ func (d *AMQPDriver) BindQueueToExchange() error {
 	return nil
 }
 
-// Consume return AMQP message channel
+// Consume set QoS and return AMQP message channel
 func (d *AMQPDriver) Consume() (<-chan amqp.Delivery, error) {
+	if d.config.PrefetchCount > 0 || d.config.PrefetchSize > 0 {
+		err := d.channel.Qos(
+			d.config.PrefetchCount, // prefetch count
+			d.config.PrefetchSize,  // prefetch size
+			false,                  // global
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var args amqp.Table
+	if d.config.ConsumerPriority != 0 {
+		args = amqp.Table{"x-priority": int32(d.config.ConsumerPriority)}
+	}
+	tagPrefix := d.config.ConsumerTag
+	if tagPrefix == "" {
+		tagPrefix = d.config.NodeName
+	}
+	d.consumerTag = fmt.Sprintf("%s-%s", tagPrefix, newUUID())
 	return d.channel.Consume(
-		d.queue.Name, // queue
-		"",           // consumer
-		false,        // auto ack
-		false,        // exclusive
-		false,        // no local
-		false,        // no wait
-		nil,          // args
+		d.queue.Name,               // queue
+		d.consumerTag,              // consumer
+		false,                      // auto ack
+		d.config.ExclusiveConsumer, // exclusive
+		false,                      // no local
+		false,                      // no wait
+		args,                       // args
 	)
 }
 
+// CancelConsume stop consuming, server will not deliver new messages
+// and the message channel returned by Consume will be closed
+func (d *AMQPDriver) CancelConsume() error {
+	if d.channel == nil || d.consumerTag == "" {
+		return nil
+	}
+	return d.channel.Cancel(d.consumerTag, false)
+}
+
 // Send send message to queue
 func (d *AMQPDriver) Send(queue string, msg []byte) error {
-	return d.channel.Publish(
+	return d.send(queue, ContentTypeXML, newUUID(), msg)
+}
+
+// send send message encoded in contentType to queue with AMQP MessageId
+func (d *AMQPDriver) send(queue, contentType, messageID string, msg []byte) error {
+	return d.Publish(
 		d.config.ExchangeName, // exchange
-		queue, // routing key
-		false, // mandatory
-		false, // immediate
+		queue,                 // routing key
 		amqp.Publishing{
-			ContentType: "text/plain",
+			ContentType: contentType,
+			MessageId:   messageID,
+			Timestamp:   time.Now(),
 			Body:        msg,
 		},
 	)
 }
 
-// Call do RPC request to queue
+// Call do RPC request to queue, timeout unit is second
 func (d *AMQPDriver) Call(queue string, msg []byte, timeout int) ([]byte, error) {
-	retQ, err := d.DeclareQueue("", true)
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	ret, err := d.CallContext(ctx, queue, msg)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeout
+	}
+	return ret, err
+}
+
+// CallContext do RPC request to queue and wait response until ctx is done
+func (d *AMQPDriver) CallContext(ctx context.Context, queue string, msg []byte) ([]byte, error) {
+	return d.call(ctx, queue, ContentTypeXML, newUUID(), msg, nil)
+}
+
+// call do RPC request with message encoded in contentType and AMQP
+// MessageId, published is set to true once request is published
+func (d *AMQPDriver) call(ctx context.Context, queue, contentType, messageID string, msg []byte, published *bool) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	replyTo, err := d.setupReplyQueue()
 	if err != nil {
 		return nil, err
 	}
-	defer d.channel.QueueDelete(retQ.Name, false, false, false)
 
-	corrId := randString()
-	err = d.channel.Publish(
+	corrId := newUUID()
+	call := &pendingCall{
+		replyTo: replyTo,
+		reply:   make(chan []byte, 1),
+	}
+	d.replyLock.Lock()
+	d.pending[corrId] = call
+	d.replyLock.Unlock()
+	defer func() {
+		d.replyLock.Lock()
+		delete(d.pending, corrId)
+		d.replyLock.Unlock()
+	}()
+
+	err = d.Publish(
 		d.config.ExchangeName, // exchange
-		queue, // routing key
-		false, // mandatory
-		false, // immediate
+		queue,                 // routing key
 		amqp.Publishing{
-			ContentType:   "text/plain",
+			ContentType:   contentType,
+			MessageId:     messageID,
 			CorrelationId: corrId,
-			ReplyTo:       retQ.Name,
+			ReplyTo:       replyTo,
+			Timestamp:     time.Now(),
 			Body:          msg,
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
-	msgs, err := d.channel.Consume(
-		retQ.Name, // queue
-		"",        // consumer
-		true,      // auto ack
-		false,     // exclusive
-		false,     // no-local
-		false,     // no-wait
-		nil,       // args
+	if published != nil {
+		*published = true
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case body, ok := <-call.reply:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return body, nil
+	}
+}
+
+// setupReplyQueue declare the driver's reply queue and start to consume it if
+// not started. All RPC requests from this driver share the reply queue.
+func (d *AMQPDriver) setupReplyQueue() (string, error) {
+	d.replyLock.Lock()
+	defer d.replyLock.Unlock()
+	if d.replyQueue != "" {
+		return d.replyQueue, nil
+	}
+	d.lock.RLock()
+	conn := d.conn
+	d.lock.RUnlock()
+	if conn == nil {
+		return "", ErrConnectionClosed
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		return "", err
+	}
+	queue, err := channel.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		channel.Close()
+		return "", err
+	}
+	msgs, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer
+		true,       // auto ack
+		true,       // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
 	)
 	if err != nil {
-		return nil, err
+		channel.Close()
+		return "", err
 	}
-	timer := time.After(time.Duration(timeout) * time.Second)
-	for {
-		select {
-		case <-timer:
-			return nil, ErrTimeout
-		case msg := <-msgs:
-			if msg.CorrelationId == corrId {
-				return msg.Body, nil
-			}
+	d.replyChannel = channel
+	d.replyQueue = queue.Name
+	go d.dispatchReplies(channel, queue.Name, msgs)
+	return d.replyQueue, nil
+}
+
+// dispatchReplies route replies to waiting callers by correlation ID
+func (d *AMQPDriver) dispatchReplies(channel *amqp.Channel, replyTo string, msgs <-chan amqp.Delivery) {
+	for msg := range msgs {
+		d.replyLock.Lock()
+		call, have := d.pending[msg.CorrelationId]
+		if have {
+			delete(d.pending, msg.CorrelationId)
 		}
+		d.replyLock.Unlock()
+		if have {
+			call.reply <- msg.Body
+		}
+	}
+	// Reply queue is gone, wake up callers still waiting on it
+	d.replyLock.Lock()
+	for corrId, call := range d.pending {
+		if call.replyTo == replyTo {
+			close(call.reply)
+			delete(d.pending, corrId)
+		}
+	}
+	if d.replyChannel == channel {
+		d.replyChannel = nil
+		d.replyQueue = ""
 	}
+	d.replyLock.Unlock()
 }
 
-func randString() string {
-	t := time.Now().String()
-	return fmt.Sprintf("%x", md5.Sum([]byte(t)))
+// timeoutContext convert timeout in seconds to a context
+func timeoutContext(timeout int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+}
+
+// channelPool keep idle AMQP channels for publishing
+type channelPool struct {
+	lock sync.Mutex
+	conn *amqp.Connection
+	size int
+	idle []*amqp.Channel
+}
+
+func newChannelPool(conn *amqp.Connection, size int) *channelPool {
+	if size <= 0 {
+		size = defaultChannelPoolSize
+	}
+	return &channelPool{
+		conn: conn,
+		size: size,
+		idle: []*amqp.Channel{},
+	}
+}
+
+// Get return an idle channel or open a new one
+func (p *channelPool) Get() (*amqp.Channel, error) {
+	p.lock.Lock()
+	if n := len(p.idle); n > 0 {
+		channel := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return channel, nil
+	}
+	p.lock.Unlock()
+	return p.conn.Channel()
+}
+
+// Put give back channel to pool, channel will be closed if pool is full
+func (p *channelPool) Put(channel *amqp.Channel) {
+	p.lock.Lock()
+	if len(p.idle) < p.size {
+		p.idle = append(p.idle, channel)
+		channel = nil
+	}
+	p.lock.Unlock()
+	if channel != nil {
+		channel.Close()
+	}
+}
+
+// Close close all idle channels
+func (p *channelPool) Close() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = []*amqp.Channel{}
+	p.lock.Unlock()
+	for _, channel := range idle {
+		channel.Close()
+	}
 }
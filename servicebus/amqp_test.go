@@ -0,0 +1,278 @@
+package servicebus
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDispatchRepliesRoutesByCorrelationID(t *testing.T) {
+	driver := newAMQPDriver("localhost", &Config{})
+	driver.replyQueue = "reply"
+	calls := make(map[string]*pendingCall)
+	for i := 0; i < 10; i++ {
+		corrId := fmt.Sprintf("corr-%d", i)
+		calls[corrId] = &pendingCall{replyTo: "reply", reply: make(chan []byte, 1)}
+		driver.pending[corrId] = calls[corrId]
+	}
+	// Call waiting on an older reply queue is not affected
+	other := &pendingCall{replyTo: "old", reply: make(chan []byte, 1)}
+	driver.pending["other"] = other
+
+	msgs := make(chan amqp.Delivery)
+	done := make(chan struct{})
+	go func() {
+		driver.dispatchReplies(nil, "reply", msgs)
+		close(done)
+	}()
+	msgs <- amqp.Delivery{CorrelationId: "unknown", Body: []byte("dropped")}
+	for i := 9; i >= 5; i-- {
+		corrId := fmt.Sprintf("corr-%d", i)
+		msgs <- amqp.Delivery{CorrelationId: corrId, Body: []byte(corrId)}
+	}
+	// Duplicated reply is dropped
+	msgs <- amqp.Delivery{CorrelationId: "corr-9", Body: []byte("again")}
+	close(msgs)
+	<-done
+
+	for i := 0; i < 10; i++ {
+		corrId := fmt.Sprintf("corr-%d", i)
+		body, ok := <-calls[corrId].reply
+		if i >= 5 && (!ok || string(body) != corrId) {
+			t.Fatalf("%s got reply %q", corrId, body)
+		}
+		if i < 5 && ok {
+			// Reply queue is gone, caller is woken up by closed channel
+			t.Fatalf("%s got reply %q after reply queue closed", corrId, body)
+		}
+	}
+	if len(driver.pending) != 1 || driver.pending["other"] != other {
+		t.Fatalf("unexpected pending calls %v", driver.pending)
+	}
+	if driver.replyQueue != "" {
+		t.Fatalf("reply queue %q is not reset", driver.replyQueue)
+	}
+}
+
+func TestCallRepliesOutOfOrder(t *testing.T) {
+	broker := newFakeBroker(t)
+	config := broker.Config()
+	responder := newAMQPDriver(broker.Addr(), config)
+	if err := responder.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	queue, err := responder.DeclareQueue("rpc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.queue = queue
+	msgs, err := responder.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	go func() {
+		// Reply after all requests arrived, in reverse order
+		requests := []amqp.Delivery{}
+		for msg := range msgs {
+			msg.Ack(false)
+			requests = append(requests, msg)
+			if len(requests) < n {
+				continue
+			}
+			responder.Publish("", msg.ReplyTo, amqp.Publishing{CorrelationId: "unknown", Body: []byte("dropped")})
+			for i := len(requests) - 1; i >= 0; i-- {
+				req := requests[i]
+				responder.Publish("", req.ReplyTo, amqp.Publishing{
+					CorrelationId: req.CorrelationId,
+					Body:          req.Body,
+				})
+			}
+			requests = requests[:0]
+		}
+	}()
+
+	client := newAMQPDriver(broker.Addr(), config)
+	if err := client.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			want := fmt.Sprintf("request-%d", i)
+			got, err := client.CallContext(ctx, "rpc", []byte(want))
+			if err == nil && string(got) != want {
+				err = fmt.Errorf("%s got reply %q", want, got)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if generated := broker.Generated(); generated != 1 {
+		t.Fatalf("%d reply queues are declared, want 1", generated)
+	}
+	client.replyLock.Lock()
+	pending := len(client.pending)
+	client.replyLock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d calls are still pending", pending)
+	}
+}
+
+func TestCallWokenUpWhenConnectionLost(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.DeclareQueue("rpc")
+	client := newAMQPDriver(broker.Addr(), broker.Config())
+	if err := client.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := client.CallContext(ctx, "rpc", []byte("request"))
+		errs <- err
+	}()
+	waitFor(t, 5*time.Second, "request published", func() bool {
+		return broker.Ready("rpc") == 1
+	})
+	broker.DropConnections()
+	if err := <-errs; err != ErrConnectionClosed {
+		t.Fatalf("got error %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestChannelPoolReconnect(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.DeclareQueue("Node1")
+	config := broker.Config()
+	config.ChannelPoolSize = 2
+	s := NewSender(config).(*smartSender)
+	defer s.Close()
+	if err := s.Send("Node1.test.echo", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := s.Send("Node1.test.echo", []byte("message")); err != nil {
+					// Sender is reconnecting
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		broker.DropConnections()
+		waitFor(t, 5*time.Second, "connection lost", func() bool {
+			return len(s.getSenders()) == 0
+		})
+		waitFor(t, 10*time.Second, "sender reconnected", func() bool {
+			return len(s.getSenders()) == 1
+		})
+	}
+	close(stop)
+	wg.Wait()
+
+	driver := s.getSenders()[0].driver
+	driver.lock.RLock()
+	pool := driver.pool
+	driver.lock.RUnlock()
+	pool.lock.Lock()
+	idle := len(pool.idle)
+	pool.lock.Unlock()
+	if idle > config.ChannelPoolSize {
+		t.Fatalf("%d idle channels, pool size is %d", idle, config.ChannelPoolSize)
+	}
+	before := broker.Ready("Node1")
+	if err := s.Send("Node1.test.echo", []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "message routed", func() bool {
+		return broker.Ready("Node1") == before+1
+	})
+}
+
+func TestDriverURI(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		config   *Config
+		scheme   string
+		host     string
+		port     int
+	}{
+		{"mq1", &Config{}, "amqp", "mq1", 5672},
+		{"mq1", &Config{Port: 5673}, "amqp", "mq1", 5673},
+		{"mq1:5674", &Config{Port: 5673}, "amqp", "mq1", 5674},
+		{"[::1]:5674", &Config{}, "amqp", "::1", 5674},
+		{"mq1", &Config{UseSSL: true}, "amqps", "mq1", 5671},
+		{"mq1", &Config{UseSSL: true, Port: 5673}, "amqps", "mq1", 5673},
+		{"mq1:5674", &Config{UseSSL: true}, "amqps", "mq1", 5674},
+		{"amqp://mq2:5675/vhost", &Config{UseSSL: true, Port: 5673}, "amqp", "mq2", 5675},
+	}
+	for _, test := range tests {
+		test.config.User = "user"
+		test.config.Password = "pass"
+		uri, err := amqp.ParseURI(newAMQPDriver(test.endpoint, test.config).uri())
+		if err != nil {
+			t.Fatalf("%q: %v", test.endpoint, err)
+		}
+		if uri.Scheme != test.scheme || uri.Host != test.host || uri.Port != test.port {
+			t.Errorf("%q: got %s://%s:%d, want %s://%s:%d", test.endpoint, uri.Scheme, uri.Host, uri.Port, test.scheme, test.host, test.port)
+		}
+		if !isURI(test.endpoint) && (uri.Username != "user" || uri.Password != "pass") {
+			t.Errorf("%q: got credentials %q, %q", test.endpoint, uri.Username, uri.Password)
+		}
+	}
+}
+
+func TestDriverURIEscapeCredentials(t *testing.T) {
+	config := &Config{User: "us@er/1", Password: "p@ss:w/rd#?%"}
+	uri, err := amqp.ParseURI(newAMQPDriver("mq1", config).uri())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Username != config.User || uri.Password != config.Password || uri.Host != "mq1" || uri.Port != 5672 {
+		t.Fatalf("unexpected uri %+v", uri)
+	}
+}
+
+func TestDialTLSRequireAMQPS(t *testing.T) {
+	configs := []*Config{
+		{TLSConfig: &tls.Config{}},
+		{ExternalAuth: true},
+	}
+	for _, config := range configs {
+		// Dial must fail before connecting
+		err := newAMQPDriver("127.0.0.1:1", config).Dial()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("got error %v, want ErrInvalidConfig", err)
+		}
+	}
+}
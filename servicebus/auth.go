@@ -0,0 +1,201 @@
+package servicebus
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuthMode decide how messages are authenticated
+type AuthMode int
+
+const (
+	// AuthToken use date based token, compatible with py-servicebus
+	AuthToken AuthMode = iota
+	// AuthHMAC sign message by HMAC-SHA256 over category, service, caller,
+	// params, timestamp and nonce. Server rejects messages out of clock skew window
+	// and replayed messages. Messages redelivered by broker, such as requeued
+	// ones, are not checked for replay.
+	AuthHMAC
+)
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+var (
+	ErrMessageExpired  = errors.New("Message timestamp out of clock skew window")
+	ErrMessageReplayed = errors.New("Message replayed")
+)
+
+// signEvent set caller and authentication fields of event by config.AuthMode
+func (c *Config) signEvent(event *EventMessage) {
+	event.Caller = c.NodeName
+	if c.AuthMode != AuthHMAC {
+		event.Token = c.generateToken("now")
+		return
+	}
+	keyID, secret := c.signingKey()
+	event.Timestamp = time.Now().Unix()
+	event.Nonce = randNonce()
+	event.KeyID = keyID
+	event.Token = signHMAC(secret, event)
+}
+
+// maxClockSkew return allowed difference between message timestamp and now
+func (c *Config) maxClockSkew() time.Duration {
+	if c.MaxClockSkew > 0 {
+		return c.MaxClockSkew
+	}
+	return defaultMaxClockSkew
+}
+
+// signHMAC return hex encoded HMAC-SHA256 signature of event
+func signHMAC(secret string, event *EventMessage) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	writeField(mac, "servicebus-hmac-v1")
+	writeField(mac, event.Category)
+	writeField(mac, event.Service)
+	writeField(mac, event.Caller)
+	writeField(mac, strconv.FormatInt(event.Timestamp, 10))
+	writeField(mac, event.Nonce)
+	writeField(mac, string(event.Params))
+	// Headers are signed only if present, so signatures of messages
+	// without headers are not changed
+	if len(event.Headers) > 0 {
+		writeField(mac, "headers")
+		for _, name := range sortedKeys(event.Headers) {
+			writeField(mac, name)
+			writeField(mac, event.Headers[name])
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeField write length prefixed field, so fields can not be shifted
+func writeField(h hash.Hash, field string) {
+	fmt.Fprintf(h, "%d:%s\n", len(field), field)
+}
+
+func randNonce() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// authenticate validate event by config.AuthMode, return ID of key which
+// signed the event. redelivered is Redelivered flag of the delivery.
+func (s *Server) authenticate(event *EventMessage, redelivered bool) (string, error) {
+	keyID, err := s.verify(event, redelivered)
+	if err != nil {
+		return "", err
+	}
+	s.keyLock.Lock()
+	s.keyUsage[keyID]++
+	s.keyLock.Unlock()
+	return keyID, nil
+}
+
+func (s *Server) verify(event *EventMessage, redelivered bool) (string, error) {
+	if s.config.AuthMode != AuthHMAC {
+		keyID, ok := s.config.validateToken(event.Token)
+		if !ok {
+			return "", ErrInvalidToken
+		}
+		return keyID, nil
+	}
+	if event.Nonce == "" {
+		return "", ErrInvalidToken
+	}
+	keyID, ok := verifyHMAC(s.config.verificationKeys(), event)
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	skew := s.config.maxClockSkew()
+	now := time.Now()
+	ts := time.Unix(event.Timestamp, 0)
+	if ts.Before(now.Add(-skew)) || ts.After(now.Add(skew)) {
+		return "", ErrMessageExpired
+	}
+	// Redelivered flag is set by broker and can not be forged by publisher.
+	// Requeued message comes back with the nonce already seen, it is not a
+	// replay.
+	if !redelivered && !s.replays.Add(event.Nonce, now) {
+		return "", ErrMessageReplayed
+	}
+	return keyID, nil
+}
+
+// verifyHMAC check event's signature by key of event.KeyID, or by every key
+// if event has no key ID
+func verifyHMAC(keys map[string]string, event *EventMessage) (string, bool) {
+	if event.KeyID != "" {
+		secret, have := keys[event.KeyID]
+		if !have {
+			return "", false
+		}
+		keys = map[string]string{event.KeyID: secret}
+	}
+	for keyID, secret := range keys {
+		expected := signHMAC(secret, event)
+		if hmac.Equal([]byte(expected), []byte(event.Token)) {
+			return keyID, true
+		}
+	}
+	return "", false
+}
+
+// KeyUsage return count of accepted messages by key ID since Server created.
+// A rotated out key can be retired when its count stops growing.
+func (s *Server) KeyUsage() map[string]uint64 {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	ret := make(map[string]uint64, len(s.keyUsage))
+	for keyID, count := range s.keyUsage {
+		ret[keyID] = count
+	}
+	return ret
+}
+
+// replayCache remember nonces of accepted messages. Nonces older than ttl
+// are forgotten, messages that old are rejected by clock skew check.
+type replayCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newReplayCache(ttl time.Duration) *replayCache {
+	return &replayCache{
+		ttl:       ttl,
+		seen:      make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// Add record nonce, return false if nonce is already seen
+func (c *replayCache) Add(nonce string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.lastPrune) > c.ttl/2 {
+		for key, seen := range c.seen {
+			if now.Sub(seen) > c.ttl {
+				delete(c.seen, key)
+			}
+		}
+		c.lastPrune = now
+	}
+	if _, have := c.seen[nonce]; have {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
@@ -0,0 +1,107 @@
+package servicebus
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	cache := newReplayCache(time.Minute)
+	if !cache.Add("a", now) {
+		t.Fatal("new nonce is rejected")
+	}
+	if cache.Add("a", now.Add(time.Second)) {
+		t.Fatal("replayed nonce is accepted")
+	}
+	if !cache.Add("b", now.Add(50*time.Second)) {
+		t.Fatal("new nonce is rejected")
+	}
+	// Cache is pruned every half ttl, a is older than ttl and forgotten
+	later := now.Add(100 * time.Second)
+	if !cache.Add("a", later) {
+		t.Fatal("nonce older than ttl is not forgotten")
+	}
+	if cache.Add("b", later) {
+		t.Fatal("nonce within ttl is forgotten")
+	}
+	if len(cache.seen) != 2 {
+		t.Fatalf("cache keeps %d nonces, want 2", len(cache.seen))
+	}
+}
+
+func TestReplayCacheConcurrent(t *testing.T) {
+	cache := newReplayCache(time.Minute)
+	var accepted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cache.Add("nonce", time.Now()) {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Fatalf("nonce accepted %d times", accepted)
+	}
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	config := &Config{
+		NodeName:    "Node1",
+		SecretToken: "secret",
+		AuthMode:    AuthHMAC,
+	}
+	server := NewServer(config)
+	defer server.sender.Close()
+	newEvent := func() *EventMessage {
+		event := &EventMessage{Category: "math", Service: "add", Params: []byte("[1, 2]")}
+		config.signEvent(event)
+		return event
+	}
+
+	event := newEvent()
+	if keyID, err := server.authenticate(event, false); err != nil || keyID != DefaultKeyID {
+		t.Fatalf("signed event: key %q, error %v", keyID, err)
+	}
+	if _, err := server.authenticate(event, false); err != ErrMessageReplayed {
+		t.Fatalf("replayed event: got error %v, want %v", err, ErrMessageReplayed)
+	}
+	// Event requeued by broker comes back with the same nonce
+	if _, err := server.authenticate(event, true); err != nil {
+		t.Fatalf("redelivered event: %v", err)
+	}
+
+	event = newEvent()
+	event.Params = []byte("[1, 3]")
+	if _, err := server.authenticate(event, false); err != ErrInvalidToken {
+		t.Fatalf("tampered event: got error %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := server.authenticate(event, true); err != ErrInvalidToken {
+		t.Fatalf("tampered redelivered event: got error %v, want %v", err, ErrInvalidToken)
+	}
+
+	event = newEvent()
+	event.Timestamp -= int64(config.maxClockSkew()/time.Second) + 1
+	event.Token = signHMAC(config.SecretToken, event)
+	if _, err := server.authenticate(event, false); err != ErrMessageExpired {
+		t.Fatalf("expired event: got error %v, want %v", err, ErrMessageExpired)
+	}
+	if _, err := server.authenticate(event, true); err != ErrMessageExpired {
+		t.Fatalf("expired redelivered event: got error %v, want %v", err, ErrMessageExpired)
+	}
+
+	event = newEvent()
+	event.Nonce = ""
+	if _, err := server.authenticate(event, false); err != ErrInvalidToken {
+		t.Fatalf("event without nonce: got error %v, want %v", err, ErrInvalidToken)
+	}
+	if usage := server.KeyUsage()[DefaultKeyID]; usage != 2 {
+		t.Fatalf("key usage is %d, want 2", usage)
+	}
+}
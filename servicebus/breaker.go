@@ -0,0 +1,289 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrCircuitOpen = errors.New("Circuit open")
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+	defaultHalfOpenRequests = 1
+)
+
+// BreakerConfig configure circuit breakers of Sender. Breakers are kept for
+// every target and every broker host.
+type BreakerConfig struct {
+	// FailureThreshold is consecutive failures to open breaker, default is 5
+	FailureThreshold int
+	// OpenTimeout is time breaker stays open before trial requests,
+	// default is 30 seconds
+	OpenTimeout time.Duration
+	// HalfOpenRequests is trial requests allowed when half-open, breaker
+	// closes after all of them succeeded, default is 1
+	HalfOpenRequests int
+}
+
+func (c *BreakerConfig) failureThreshold() int {
+	if c.FailureThreshold > 0 {
+		return c.FailureThreshold
+	}
+	return defaultFailureThreshold
+}
+
+func (c *BreakerConfig) openTimeout() time.Duration {
+	if c.OpenTimeout > 0 {
+		return c.OpenTimeout
+	}
+	return defaultOpenTimeout
+}
+
+func (c *BreakerConfig) halfOpenRequests() int {
+	if c.HalfOpenRequests > 0 {
+		return c.HalfOpenRequests
+	}
+	return defaultHalfOpenRequests
+}
+
+// BreakerState is state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed let all requests through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fail requests fast with ErrCircuitOpen
+	BreakerOpen
+	// BreakerHalfOpen let limited trial requests through
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerStatus is snapshot of a circuit breaker for dashboards
+type BreakerStatus struct {
+	// Kind is "target" or "host"
+	Kind string
+	// Name is target or broker host
+	Name     string
+	State    BreakerState
+	Failures int
+	// OpenedAt is last time breaker opened
+	OpenedAt time.Time
+}
+
+// BreakerReporter is implemented by Senders created by NewSender
+type BreakerReporter interface {
+	// Breakers return status of all circuit breakers
+	Breakers() []BreakerStatus
+}
+
+// circuitBreaker count consecutive failures of a target or host
+type circuitBreaker struct {
+	lock      sync.Mutex
+	config    *BreakerConfig
+	state     BreakerState
+	failures  int
+	successes int
+	inFlight  int
+	openedAt  time.Time
+}
+
+// Allow report whether a request can go through, a trial slot is taken if
+// breaker is half-open
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen {
+		if now.Sub(b.openedAt) < b.config.openTimeout() {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.successes = 0
+		b.inFlight = 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.inFlight >= b.config.halfOpenRequests() {
+			return false
+		}
+		b.inFlight++
+	}
+	return true
+}
+
+// IsOpen report whether breaker rejects requests now, it does not change state
+func (b *circuitBreaker) IsOpen(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state == BreakerOpen && now.Sub(b.openedAt) < b.config.openTimeout()
+}
+
+// Record record result of an allowed request
+func (b *circuitBreaker) Record(failed bool, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.failureThreshold() {
+			b.open(now)
+		}
+	case BreakerHalfOpen:
+		if b.inFlight > 0 {
+			b.inFlight--
+		}
+		if failed {
+			b.failures++
+			b.open(now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.halfOpenRequests() {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+	}
+}
+
+// Release give back trial slot of a request with no result, such as a
+// request canceled by caller
+func (b *circuitBreaker) Release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerHalfOpen && b.inFlight > 0 {
+		b.inFlight--
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) status(kind, name string) BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return BreakerStatus{
+		Kind:     kind,
+		Name:     name,
+		State:    b.state,
+		Failures: b.failures,
+		OpenedAt: b.openedAt,
+	}
+}
+
+// breakerSet keep circuit breakers of targets and hosts
+type breakerSet struct {
+	lock    sync.Mutex
+	config  *BreakerConfig
+	targets map[string]*circuitBreaker
+	hosts   map[string]*circuitBreaker
+}
+
+func newBreakerSet(config *BreakerConfig) *breakerSet {
+	return &breakerSet{
+		config:  config,
+		targets: make(map[string]*circuitBreaker),
+		hosts:   make(map[string]*circuitBreaker),
+	}
+}
+
+func (s *breakerSet) Target(target string) *circuitBreaker {
+	return s.get(s.targets, target)
+}
+
+func (s *breakerSet) Host(host string) *circuitBreaker {
+	return s.get(s.hosts, host)
+}
+
+func (s *breakerSet) get(breakers map[string]*circuitBreaker, name string) *circuitBreaker {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, have := breakers[name]
+	if !have {
+		b = &circuitBreaker{config: s.config}
+		breakers[name] = b
+	}
+	return b
+}
+
+// Statuses return status of all breakers sorted by kind and name
+func (s *breakerSet) Statuses() []BreakerStatus {
+	s.lock.Lock()
+	ret := make([]BreakerStatus, 0, len(s.targets)+len(s.hosts))
+	for name, b := range s.targets {
+		ret = append(ret, b.status("target", name))
+	}
+	for name, b := range s.hosts {
+		ret = append(ret, b.status("host", name))
+	}
+	s.lock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Kind != ret[j].Kind {
+			return ret[i].Kind < ret[j].Kind
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// isTargetFailure report whether err means target is unavailable. Errors
+// replied by service mean it is alive, except busy errors.
+func isTargetFailure(err error) bool {
+	switch err {
+	case ErrTimeout, context.DeadlineExceeded, ErrPingFailed:
+		return true
+	}
+	if isHostFailure(err) {
+		return true
+	}
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		return rerr.Code == ErrCodeBusy
+	}
+	return false
+}
+
+// isHostFailure report whether err means broker connection is broken. RPC
+// timeouts are not counted, a dead service must not open breakers of hosts
+// shared by all targets.
+func isHostFailure(err error) bool {
+	switch err {
+	case ErrConnectionClosed, ErrCannotConnectToServer:
+		return true
+	}
+	var aerr *amqp.Error
+	return errors.As(err, &aerr)
+}
+
+// recordBreaker record err to breaker by isFailure, canceled request only
+// release slot
+func recordBreaker(b *circuitBreaker, err error, isFailure func(error) bool, now time.Time) {
+	if err == context.Canceled {
+		b.Release()
+		return
+	}
+	b.Record(isFailure(err), now)
+}
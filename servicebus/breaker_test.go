@@ -0,0 +1,155 @@
+package servicebus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestBreakerStateMachine(t *testing.T) {
+	b := &circuitBreaker{config: &BreakerConfig{
+		FailureThreshold: 3,
+		OpenTimeout:      time.Second,
+		HalfOpenRequests: 2,
+	}}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 2; i++ {
+		b.Record(true, now)
+	}
+	// Success resets consecutive failures
+	b.Record(false, now)
+	for i := 0; i < 2; i++ {
+		b.Record(true, now)
+	}
+	if !b.Allow(now) || b.state != BreakerClosed {
+		t.Fatalf("breaker is %v after 2 consecutive failures", b.state)
+	}
+	b.Record(true, now)
+	if b.state != BreakerOpen || !b.IsOpen(now) || b.Allow(now.Add(999*time.Millisecond)) {
+		t.Fatalf("breaker is %v after 3 consecutive failures", b.state)
+	}
+
+	// Half-open allows HalfOpenRequests trials
+	now = now.Add(time.Second)
+	if b.IsOpen(now) {
+		t.Fatal("breaker is open after OpenTimeout")
+	}
+	if !b.Allow(now) || !b.Allow(now) || b.Allow(now) {
+		t.Fatal("half-open breaker does not allow exactly 2 trials")
+	}
+	if b.state != BreakerHalfOpen {
+		t.Fatalf("breaker is %v, want half-open", b.state)
+	}
+	// Canceled trial gives back its slot
+	b.Release()
+	if !b.Allow(now) {
+		t.Fatal("released slot is not reused")
+	}
+	b.Record(false, now)
+	if b.state != BreakerHalfOpen {
+		t.Fatalf("breaker is %v after 1 of 2 trials succeeded", b.state)
+	}
+	b.Record(false, now)
+	if b.state != BreakerClosed || b.failures != 0 {
+		t.Fatalf("breaker is %v with %d failures after trials succeeded", b.state, b.failures)
+	}
+
+	// Failed trial opens breaker again
+	for i := 0; i < 3; i++ {
+		b.Record(true, now)
+	}
+	now = now.Add(time.Second)
+	if !b.Allow(now) {
+		t.Fatal("half-open breaker does not allow trial")
+	}
+	b.Record(true, now)
+	if b.state != BreakerOpen || !b.openedAt.Equal(now) || b.Allow(now) {
+		t.Fatalf("breaker is %v opened at %v after failed trial", b.state, b.openedAt)
+	}
+}
+
+func TestBreakerFailures(t *testing.T) {
+	tests := []struct {
+		err    error
+		target bool
+		host   bool
+	}{
+		{nil, false, false},
+		{ErrTimeout, true, false},
+		{context.DeadlineExceeded, true, false},
+		{ErrPingFailed, true, false},
+		{ErrConnectionClosed, true, true},
+		{ErrCannotConnectToServer, true, true},
+		{amqp.ErrClosed, true, true},
+		{&amqp.Error{Code: 504, Reason: "CHANNEL_ERROR"}, true, true},
+		{NewRemoteError(ErrCodeBusy, "busy"), true, false},
+		{NewRemoteError(ErrCodeServiceError, "failed"), false, false},
+		{ErrInvalidPayload, false, false},
+	}
+	for _, test := range tests {
+		if ret := isTargetFailure(test.err); ret != test.target {
+			t.Errorf("isTargetFailure(%v) = %v", test.err, ret)
+		}
+		if ret := isHostFailure(test.err); ret != test.host {
+			t.Errorf("isHostFailure(%v) = %v", test.err, ret)
+		}
+	}
+}
+
+func TestRecordBreakerCanceled(t *testing.T) {
+	b := &circuitBreaker{config: &BreakerConfig{FailureThreshold: 1}}
+	recordBreaker(b, context.Canceled, isTargetFailure, time.Now())
+	if b.state != BreakerClosed {
+		t.Fatalf("canceled request opens breaker")
+	}
+	recordBreaker(b, ErrTimeout, isHostFailure, time.Now())
+	if b.state != BreakerClosed {
+		t.Fatalf("timeout opens host breaker")
+	}
+	recordBreaker(b, ErrTimeout, isTargetFailure, time.Now())
+	if b.state != BreakerOpen {
+		t.Fatalf("timeout does not open target breaker")
+	}
+}
+
+func TestTimeoutsOnlyOpenTargetBreaker(t *testing.T) {
+	broker := newFakeBroker(t)
+	// Queue without consumer, calls to it always time out
+	broker.DeclareQueue("Node1")
+	config := broker.Config()
+	config.CircuitBreaker = &BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute}
+	sender := NewSender(config)
+	defer sender.Close()
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := sender.CallContext(ctx, "Node1.dead.service", []byte("request"))
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+	if _, err := sender.Call("Node1.dead.service", []byte("request"), 1); err != ErrCircuitOpen {
+		t.Fatalf("got error %v, want %v", err, ErrCircuitOpen)
+	}
+	// Other targets on the same host are not affected
+	if err := sender.Send("Node1.live.service", []byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	statuses := sender.(BreakerReporter).Breakers()
+	want := []BreakerStatus{
+		{Kind: "host", Name: broker.Addr(), State: BreakerClosed},
+		{Kind: "target", Name: "Node1.dead.service", State: BreakerOpen, Failures: 2},
+		{Kind: "target", Name: "Node1.live.service", State: BreakerClosed},
+	}
+	if len(statuses) != len(want) {
+		t.Fatalf("unexpected breakers %+v", statuses)
+	}
+	for i, status := range statuses {
+		status.OpenedAt = time.Time{}
+		if status != want[i] {
+			t.Fatalf("breaker %d is %+v, want %+v", i, status, want[i])
+		}
+	}
+}
@@ -0,0 +1,894 @@
+package servicebus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is an in-process AMQP 0-9-1 broker for tests. It implements the
+// methods used by AMQPDriver: connection and channel lifecycle, exchange and
+// queue declaring, binding, QoS, consuming, publishing, acknowledgement and
+// routing by default exchange and direct exchanges.
+type fakeBroker struct {
+	listener  net.Listener
+	lock      sync.Mutex
+	conns     map[*fakeConn]bool
+	queues    map[string]*fakeQueue
+	exchanges map[string]bool
+	// bindings is queue name by exchange and routing key
+	bindings map[string]map[string]string
+	// generated is count of server-named queues ever declared
+	generated int
+	// dropped and requeued are count of deliveries rejected by clients
+	dropped  int
+	requeued int
+	nextTag  int
+	wg       sync.WaitGroup
+}
+
+type fakeQueue struct {
+	name       string
+	owner      *fakeConn
+	autoDelete bool
+	messages   []*fakeMessage
+	consumers  []*fakeConsumer
+	next       int
+}
+
+type fakeMessage struct {
+	exchange    string
+	key         string
+	properties  []byte
+	body        []byte
+	redelivered bool
+}
+
+type fakeConsumer struct {
+	tag     string
+	queue   *fakeQueue
+	channel *fakeChannel
+	noAck   bool
+}
+
+type fakeDelivery struct {
+	queue   *fakeQueue
+	message *fakeMessage
+}
+
+type fakeChannel struct {
+	id        uint16
+	conn      *fakeConn
+	prefetch  int
+	nextTag   uint64
+	unacked   map[uint64]*fakeDelivery
+	consumers map[string]*fakeConsumer
+	// publishing is message waiting for its content header and body
+	publishing *fakeMessage
+	bodySize   uint64
+}
+
+type fakeConn struct {
+	broker   *fakeBroker
+	conn     net.Conn
+	channels map[uint16]*fakeChannel
+	// out is frames waiting to be written by writeLoop
+	outLock sync.Mutex
+	out     [][]byte
+	wake    chan struct{}
+	closed  bool
+}
+
+const (
+	fakeFrameMethod    = 1
+	fakeFrameHeader    = 2
+	fakeFrameBody      = 3
+	fakeFrameHeartbeat = 8
+	fakeFrameEnd       = 0xce
+	fakeFrameMax       = 131072
+)
+
+// newFakeBroker start a broker on a random local port, it is closed when
+// test finished
+func newFakeBroker(t testing.TB) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		listener:  listener,
+		conns:     make(map[*fakeConn]bool),
+		queues:    make(map[string]*fakeQueue),
+		exchanges: make(map[string]bool),
+		bindings:  make(map[string]map[string]string),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Addr return broker address in host:port format
+func (b *fakeBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Config return a Config connecting to broker
+func (b *fakeBroker) Config() *Config {
+	return &Config{
+		Hosts:       []string{b.Addr()},
+		User:        "guest",
+		Password:    "guest",
+		NodeName:    "Node1",
+		SecretToken: "secret",
+	}
+}
+
+// Close stop accepting connections and close all connections
+func (b *fakeBroker) Close() {
+	b.listener.Close()
+	b.DropConnections()
+	b.wg.Wait()
+}
+
+// DropConnections close all client connections without AMQP handshake, as
+// network failure does
+func (b *fakeBroker) DropConnections() {
+	b.lock.Lock()
+	conns := make([]*fakeConn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.lock.Unlock()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+// Connections return count of open client connections
+func (b *fakeBroker) Connections() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.conns)
+}
+
+// Generated return count of server-named queues ever declared
+func (b *fakeBroker) Generated() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.generated
+}
+
+// Dropped return count of deliveries rejected without requeue
+func (b *fakeBroker) Dropped() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
+
+// Requeued return count of deliveries rejected with requeue
+func (b *fakeBroker) Requeued() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.requeued
+}
+
+// DeclareQueue declare a durable queue without owner
+func (b *fakeBroker) DeclareQueue(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, have := b.queues[name]; !have {
+		b.queues[name] = &fakeQueue{name: name}
+	}
+}
+
+// Queues return names of declared queues
+func (b *fakeBroker) Queues() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	names := make([]string, 0, len(b.queues))
+	for name := range b.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Ready return count of messages in queue waiting for delivery
+func (b *fakeBroker) Ready(queue string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, have := b.queues[queue]; have {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// Consumers return count of consumers of queue
+func (b *fakeBroker) Consumers(queue string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, have := b.queues[queue]; have {
+		return len(q.consumers)
+	}
+	return 0
+}
+
+// waitFor poll cond until it is true or timeout
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *fakeBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{
+			broker:   b,
+			conn:     conn,
+			channels: make(map[uint16]*fakeChannel),
+			wake:     make(chan struct{}, 1),
+		}
+		b.lock.Lock()
+		b.conns[c] = true
+		b.lock.Unlock()
+		b.wg.Add(2)
+		go c.writeLoop()
+		go c.serve()
+	}
+}
+
+// serve read frames of connection until it is closed
+func (c *fakeConn) serve() {
+	defer c.broker.wg.Done()
+	defer c.shutdown()
+	r := bufio.NewReader(c.conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	start := &fakeWriter{}
+	start.octet(0)
+	start.octet(9)
+	start.table()
+	start.longstr("PLAIN AMQPLAIN EXTERNAL")
+	start.longstr("en_US")
+	c.sendMethod(0, 10, 10, start)
+	for {
+		typ, channel, payload, err := readFakeFrame(r)
+		if err != nil {
+			return
+		}
+		c.broker.lock.Lock()
+		done := c.handleFrame(typ, channel, payload)
+		c.broker.lock.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func readFakeFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[size] != fakeFrameEnd {
+		return 0, 0, nil, fmt.Errorf("bad frame end %x", payload[size])
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:size], nil
+}
+
+// writeLoop write queued frames, so broker never blocks on client socket
+// while holding its lock. Socket is closed after queued frames are written
+// when connection is shut down.
+func (c *fakeConn) writeLoop() {
+	defer c.broker.wg.Done()
+	defer c.conn.Close()
+	for range c.wake {
+		c.outLock.Lock()
+		out := c.out
+		c.out = nil
+		c.outLock.Unlock()
+		for _, frame := range out {
+			if _, err := c.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *fakeConn) sendFrame(typ byte, channel uint16, payload []byte) {
+	frame := make([]byte, 7, len(payload)+8)
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:], channel)
+	binary.BigEndian.PutUint32(frame[3:], uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = append(frame, fakeFrameEnd)
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+	if c.closed {
+		return
+	}
+	c.out = append(c.out, frame)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *fakeConn) sendMethod(channel uint16, class, method uint16, args *fakeWriter) {
+	payload := &fakeWriter{}
+	payload.short(class)
+	payload.short(method)
+	if args != nil {
+		payload.buf = append(payload.buf, args.buf...)
+	}
+	c.sendFrame(fakeFrameMethod, channel, payload.buf)
+}
+
+// closeChannel close channel by broker with AMQP error
+func (c *fakeConn) closeChannel(ch *fakeChannel, code uint16, text string, class, method uint16) {
+	args := &fakeWriter{}
+	args.short(code)
+	args.shortstr(text)
+	args.short(class)
+	args.short(method)
+	c.sendMethod(ch.id, 20, 40, args)
+	c.releaseChannel(ch)
+}
+
+// shutdown release all resources of connection
+func (c *fakeConn) shutdown() {
+	b := c.broker
+	b.lock.Lock()
+	for _, ch := range c.channels {
+		c.releaseChannel(ch)
+	}
+	for name, q := range b.queues {
+		if q.owner == c {
+			delete(b.queues, name)
+		}
+	}
+	delete(b.conns, c)
+	b.lock.Unlock()
+	c.outLock.Lock()
+	c.closed = true
+	// Wake writeLoop for the last time, it writes left frames and exits
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	close(c.wake)
+	c.outLock.Unlock()
+}
+
+// releaseChannel cancel consumers of channel and requeue its unacked
+// messages
+func (c *fakeConn) releaseChannel(ch *fakeChannel) {
+	if _, have := c.channels[ch.id]; !have {
+		return
+	}
+	delete(c.channels, ch.id)
+	for _, consumer := range ch.consumers {
+		c.broker.cancelConsumer(consumer)
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		c.broker.requeue(ch.unacked[tag])
+	}
+	ch.unacked = nil
+}
+
+// handleFrame process one frame, it returns true if connection is closed
+func (c *fakeConn) handleFrame(typ byte, channel uint16, payload []byte) bool {
+	switch typ {
+	case fakeFrameHeartbeat:
+		return false
+	case fakeFrameHeader:
+		ch := c.channels[channel]
+		if ch == nil || ch.publishing == nil {
+			return false
+		}
+		r := &fakeReader{buf: payload}
+		r.short() // class
+		r.short() // weight
+		ch.bodySize = r.longlong()
+		ch.publishing.properties = append([]byte{}, r.buf...)
+		if ch.bodySize == 0 {
+			c.broker.route(ch.publishing)
+			ch.publishing = nil
+		}
+		return false
+	case fakeFrameBody:
+		ch := c.channels[channel]
+		if ch == nil || ch.publishing == nil {
+			return false
+		}
+		ch.publishing.body = append(ch.publishing.body, payload...)
+		if uint64(len(ch.publishing.body)) >= ch.bodySize {
+			c.broker.route(ch.publishing)
+			ch.publishing = nil
+		}
+		return false
+	case fakeFrameMethod:
+	default:
+		return true
+	}
+	r := &fakeReader{buf: payload}
+	class, method := r.short(), r.short()
+	if class == 10 {
+		return c.handleConnection(method, r)
+	}
+	if class == 20 && method == 10 {
+		c.channels[channel] = &fakeChannel{
+			id:        channel,
+			conn:      c,
+			unacked:   make(map[uint64]*fakeDelivery),
+			consumers: make(map[string]*fakeConsumer),
+		}
+		args := &fakeWriter{}
+		args.longstr("")
+		c.sendMethod(channel, 20, 11, args)
+		return false
+	}
+	ch := c.channels[channel]
+	if ch == nil {
+		// Channel closed by broker, wait for client's close-ok
+		return false
+	}
+	switch class {
+	case 20:
+		c.handleChannel(ch, method, r)
+	case 40:
+		c.handleExchange(ch, method, r)
+	case 50:
+		c.handleQueue(ch, method, r)
+	case 60:
+		c.handleBasic(ch, method, r)
+	default:
+		c.closeChannel(ch, 540, "NOT_IMPLEMENTED", class, method)
+	}
+	return false
+}
+
+func (c *fakeConn) handleConnection(method uint16, r *fakeReader) bool {
+	switch method {
+	case 11: // start-ok
+		tune := &fakeWriter{}
+		tune.short(2047)
+		tune.long(fakeFrameMax)
+		tune.short(0)
+		c.sendMethod(0, 10, 30, tune)
+	case 31: // tune-ok
+	case 40: // open
+		args := &fakeWriter{}
+		args.shortstr("")
+		c.sendMethod(0, 10, 41, args)
+	case 50: // close
+		c.sendMethod(0, 10, 51, nil)
+		return true
+	case 51: // close-ok
+		return true
+	}
+	return false
+}
+
+func (c *fakeConn) handleChannel(ch *fakeChannel, method uint16, r *fakeReader) {
+	switch method {
+	case 40: // close
+		c.releaseChannel(ch)
+		c.sendMethod(ch.id, 20, 41, nil)
+	case 41: // close-ok
+		c.releaseChannel(ch)
+	default:
+		c.closeChannel(ch, 540, "NOT_IMPLEMENTED", 20, method)
+	}
+}
+
+func (c *fakeConn) handleExchange(ch *fakeChannel, method uint16, r *fakeReader) {
+	if method != 10 {
+		c.closeChannel(ch, 540, "NOT_IMPLEMENTED", 40, method)
+		return
+	}
+	r.short()
+	name := r.shortstr()
+	r.shortstr() // type
+	bits := r.octet()
+	passive, noWait := bits&1 != 0, bits&16 != 0
+	if passive && !c.broker.exchanges[name] {
+		c.closeChannel(ch, 404, "NOT_FOUND - no exchange '"+name+"'", 40, 10)
+		return
+	}
+	c.broker.exchanges[name] = true
+	if !noWait {
+		c.sendMethod(ch.id, 40, 11, nil)
+	}
+}
+
+func (c *fakeConn) handleQueue(ch *fakeChannel, method uint16, r *fakeReader) {
+	b := c.broker
+	switch method {
+	case 10: // declare
+		r.short()
+		name := r.shortstr()
+		bits := r.octet()
+		passive, exclusive, autoDelete, noWait := bits&1 != 0, bits&4 != 0, bits&8 != 0, bits&16 != 0
+		if name == "" {
+			b.generated++
+			name = fmt.Sprintf("amq.gen-%d", b.generated)
+		}
+		q, have := b.queues[name]
+		if have && q.owner != nil && q.owner != c {
+			c.closeChannel(ch, 405, "RESOURCE_LOCKED - queue '"+name+"'", 50, 10)
+			return
+		}
+		if !have {
+			if passive {
+				c.closeChannel(ch, 404, "NOT_FOUND - no queue '"+name+"'", 50, 10)
+				return
+			}
+			q = &fakeQueue{name: name, autoDelete: autoDelete}
+			if exclusive {
+				q.owner = c
+			}
+			b.queues[name] = q
+		}
+		if !noWait {
+			args := &fakeWriter{}
+			args.shortstr(name)
+			args.long(uint32(len(q.messages)))
+			args.long(uint32(len(q.consumers)))
+			c.sendMethod(ch.id, 50, 11, args)
+		}
+	case 20: // bind
+		r.short()
+		queue := r.shortstr()
+		exchange := r.shortstr()
+		key := r.shortstr()
+		noWait := r.octet()&1 != 0
+		if _, have := b.queues[queue]; !have {
+			c.closeChannel(ch, 404, "NOT_FOUND - no queue '"+queue+"'", 50, 20)
+			return
+		}
+		if b.bindings[exchange] == nil {
+			b.bindings[exchange] = make(map[string]string)
+		}
+		b.bindings[exchange][key] = queue
+		if !noWait {
+			c.sendMethod(ch.id, 50, 21, nil)
+		}
+	default:
+		c.closeChannel(ch, 540, "NOT_IMPLEMENTED", 50, method)
+	}
+}
+
+func (c *fakeConn) handleBasic(ch *fakeChannel, method uint16, r *fakeReader) {
+	b := c.broker
+	switch method {
+	case 10: // qos
+		r.long()
+		ch.prefetch = int(r.short())
+		c.sendMethod(ch.id, 60, 11, nil)
+		for _, q := range b.queues {
+			b.deliver(q)
+		}
+	case 20: // consume
+		r.short()
+		queue := r.shortstr()
+		tag := r.shortstr()
+		bits := r.octet()
+		noAck, noWait := bits&2 != 0, bits&8 != 0
+		q, have := b.queues[queue]
+		if !have {
+			c.closeChannel(ch, 404, "NOT_FOUND - no queue '"+queue+"'", 60, 20)
+			return
+		}
+		if tag == "" {
+			b.nextTag++
+			tag = fmt.Sprintf("amq.ctag-%d", b.nextTag)
+		}
+		consumer := &fakeConsumer{tag: tag, queue: q, channel: ch, noAck: noAck}
+		ch.consumers[tag] = consumer
+		q.consumers = append(q.consumers, consumer)
+		if !noWait {
+			args := &fakeWriter{}
+			args.shortstr(tag)
+			c.sendMethod(ch.id, 60, 21, args)
+		}
+		b.deliver(q)
+	case 30: // cancel
+		tag := r.shortstr()
+		noWait := r.octet()&1 != 0
+		if consumer, have := ch.consumers[tag]; have {
+			delete(ch.consumers, tag)
+			b.cancelConsumer(consumer)
+		}
+		if !noWait {
+			args := &fakeWriter{}
+			args.shortstr(tag)
+			c.sendMethod(ch.id, 60, 31, args)
+		}
+	case 40: // publish
+		r.short()
+		exchange := r.shortstr()
+		key := r.shortstr()
+		ch.publishing = &fakeMessage{exchange: exchange, key: key}
+	case 80: // ack
+		tag := r.longlong()
+		multiple := r.octet()&1 != 0
+		for _, d := range ch.settle(tag, multiple) {
+			b.deliver(d.queue)
+		}
+	case 90: // reject
+		tag := r.longlong()
+		requeue := r.octet()&1 != 0
+		b.settle(ch.settle(tag, false), requeue)
+	case 120: // nack
+		tag := r.longlong()
+		bits := r.octet()
+		b.settle(ch.settle(tag, bits&1 != 0), bits&2 != 0)
+	default:
+		c.closeChannel(ch, 540, "NOT_IMPLEMENTED", 60, method)
+	}
+}
+
+// settle remove deliveries acknowledged by tag from unacked
+func (ch *fakeChannel) settle(tag uint64, multiple bool) []*fakeDelivery {
+	var ret []*fakeDelivery
+	for t, d := range ch.unacked {
+		if t == tag || (multiple && t < tag) {
+			ret = append(ret, d)
+			delete(ch.unacked, t)
+		}
+	}
+	return ret
+}
+
+// settle requeue or drop rejected deliveries
+func (b *fakeBroker) settle(deliveries []*fakeDelivery, requeue bool) {
+	for _, d := range deliveries {
+		if requeue {
+			b.requeued++
+			b.requeue(d)
+		} else {
+			b.dropped++
+			b.deliver(d.queue)
+		}
+	}
+}
+
+func (b *fakeBroker) requeue(d *fakeDelivery) {
+	if b.queues[d.queue.name] != d.queue {
+		return
+	}
+	msg := *d.message
+	msg.redelivered = true
+	d.queue.messages = append([]*fakeMessage{&msg}, d.queue.messages...)
+	b.deliver(d.queue)
+}
+
+func (b *fakeBroker) cancelConsumer(consumer *fakeConsumer) {
+	q := consumer.queue
+	for i, c := range q.consumers {
+		if c == consumer {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.autoDelete && len(q.consumers) == 0 && b.queues[q.name] == q {
+		delete(b.queues, q.name)
+	}
+}
+
+// route put published message to queue by exchange and routing key,
+// unroutable message is dropped
+func (b *fakeBroker) route(msg *fakeMessage) {
+	name := msg.key
+	if msg.exchange != "" {
+		name = b.bindings[msg.exchange][msg.key]
+	}
+	q, have := b.queues[name]
+	if !have {
+		return
+	}
+	q.messages = append(q.messages, msg)
+	b.deliver(q)
+}
+
+// deliver push ready messages of queue to its consumers in round robin,
+// consumers reached prefetch limit are skipped
+func (b *fakeBroker) deliver(q *fakeQueue) {
+	for len(q.messages) > 0 {
+		consumer := q.nextConsumer()
+		if consumer == nil {
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		ch := consumer.channel
+		ch.nextTag++
+		if !consumer.noAck {
+			ch.unacked[ch.nextTag] = &fakeDelivery{queue: q, message: msg}
+		}
+		args := &fakeWriter{}
+		args.shortstr(consumer.tag)
+		args.longlong(ch.nextTag)
+		if msg.redelivered {
+			args.octet(1)
+		} else {
+			args.octet(0)
+		}
+		args.shortstr(msg.exchange)
+		args.shortstr(msg.key)
+		ch.conn.sendMethod(ch.id, 60, 60, args)
+		header := &fakeWriter{}
+		header.short(60)
+		header.short(0)
+		header.longlong(uint64(len(msg.body)))
+		header.buf = append(header.buf, msg.properties...)
+		ch.conn.sendFrame(fakeFrameHeader, ch.id, header.buf)
+		for body := msg.body; len(body) > 0; {
+			n := len(body)
+			if n > fakeFrameMax-8 {
+				n = fakeFrameMax - 8
+			}
+			ch.conn.sendFrame(fakeFrameBody, ch.id, body[:n])
+			body = body[n:]
+		}
+	}
+}
+
+func (q *fakeQueue) nextConsumer() *fakeConsumer {
+	for i := 0; i < len(q.consumers); i++ {
+		consumer := q.consumers[(q.next+i)%len(q.consumers)]
+		ch := consumer.channel
+		if consumer.noAck || ch.prefetch == 0 || len(ch.unacked) < ch.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return consumer
+		}
+	}
+	return nil
+}
+
+// fakeWriter encode AMQP method arguments
+type fakeWriter struct {
+	buf []byte
+}
+
+func (w *fakeWriter) octet(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *fakeWriter) short(v uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+}
+
+func (w *fakeWriter) long(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *fakeWriter) longlong(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *fakeWriter) shortstr(v string) {
+	w.octet(byte(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *fakeWriter) longstr(v string) {
+	w.long(uint32(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// table write an empty field table
+func (w *fakeWriter) table() {
+	w.long(0)
+}
+
+// fakeReader decode AMQP method arguments, missing bytes are read as zero
+type fakeReader struct {
+	buf []byte
+}
+
+func (r *fakeReader) next(n int) []byte {
+	if n > len(r.buf) {
+		r.buf = append(r.buf, make([]byte, n-len(r.buf))...)
+	}
+	ret := r.buf[:n]
+	r.buf = r.buf[n:]
+	return ret
+}
+
+func (r *fakeReader) octet() byte {
+	return r.next(1)[0]
+}
+
+func (r *fakeReader) short() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *fakeReader) long() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *fakeReader) longlong() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *fakeReader) shortstr() string {
+	return string(r.next(int(r.octet())))
+}
+
+func TestFakeBrokerRouting(t *testing.T) {
+	broker := newFakeBroker(t)
+	config := broker.Config()
+	config.ExchangeName = "servicebus"
+	driver := newAMQPDriver(broker.Addr(), config)
+	if err := driver.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	// Exchange is not declared, driver reopen channel and keep going
+	if err := driver.BindQueueToExchange(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(broker.Queues(), ","), "Node1") {
+		t.Fatalf("queue is not declared: %v", broker.Queues())
+	}
+	broker.lock.Lock()
+	broker.exchanges["servicebus"] = true
+	broker.lock.Unlock()
+	if err := driver.BindQueueToExchange(); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Send("Node1", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "message routed", func() bool {
+		return broker.Ready("Node1") == 1
+	})
+	msgs, err := driver.Consume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if string(msg.Body) != "hello" || msg.ContentType != ContentTypeXML || msg.MessageId == "" {
+		t.Fatalf("unexpected delivery %+v", msg)
+	}
+	if err := msg.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	msg = <-msgs
+	if !msg.Redelivered || string(msg.Body) != "hello" {
+		t.Fatalf("message is not redelivered: %+v", msg)
+	}
+	msg.Ack(false)
+}
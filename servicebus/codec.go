@@ -0,0 +1,399 @@
+package servicebus
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	ErrUnknownCodec = errors.New("Unknown content type")
+)
+
+const (
+	// ContentTypeXML is content type of XML envelope, py-servicebus only
+	// understand this one
+	ContentTypeXML = "text/plain"
+	// ContentTypeJSON is content type of JSON envelope
+	ContentTypeJSON = "application/json"
+	// ContentTypeMsgpack is content type of MessagePack envelope
+	ContentTypeMsgpack = "application/msgpack"
+	// ContentTypeProtobuf is content type of protobuf envelope
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec encode and decode message envelopes. Codec is chosen by AMQP
+// ContentType of received message, and reply is encoded by the same Codec.
+type Codec interface {
+	// ContentType is AMQP ContentType of encoded messages
+	ContentType() string
+	EncodeEvent(event *EventMessage) ([]byte, error)
+	DecodeEvent(data []byte) (*EventMessage, error)
+	EncodeResponse(resp *EventResponse) ([]byte, error)
+	DecodeResponse(data []byte) (*EventResponse, error)
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = map[string]Codec{
+		ContentTypeXML:      XMLCodec(),
+		ContentTypeJSON:     JSONCodec(),
+		ContentTypeMsgpack:  MsgpackCodec(),
+		ContentTypeProtobuf: ProtobufCodec(),
+	}
+)
+
+// RegisterCodec register codec for its ContentType, registered codec with
+// same ContentType is replaced
+func RegisterCodec(codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// codecFor return Codec for contentType, empty contentType means XML
+func codecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeXML
+	}
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	codec, have := codecs[contentType]
+	if !have {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// codec return Codec for Sender, nil means XMLCodec
+func (c *Config) codec() Codec {
+	if c.Codec != nil {
+		return c.Codec
+	}
+	return XMLCodec()
+}
+
+// XMLCodec return Codec of `<event version="1">` XML envelope, which is
+// compatible with py-servicebus
+func XMLCodec() Codec {
+	return xmlCodec{}
+}
+
+type xmlCodec struct{}
+
+func (xmlCodec) ContentType() string {
+	return ContentTypeXML
+}
+
+func (xmlCodec) EncodeEvent(event *EventMessage) ([]byte, error) {
+	return event.toXML(), nil
+}
+
+func (xmlCodec) DecodeEvent(data []byte) (*EventMessage, error) {
+	return decodeEventMessage(data)
+}
+
+func (xmlCodec) EncodeResponse(resp *EventResponse) ([]byte, error) {
+	return resp.toXML(), nil
+}
+
+func (xmlCodec) DecodeResponse(data []byte) (*EventResponse, error) {
+	return decodeEventResponse(data)
+}
+
+// JSONCodec return Codec of JSON envelope
+func JSONCodec() Codec {
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) EncodeEvent(event *EventMessage) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (jsonCodec) DecodeEvent(data []byte) (*EventMessage, error) {
+	ret := &EventMessage{}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, ErrInvalidEvent
+	}
+	return ret, nil
+}
+
+func (jsonCodec) EncodeResponse(resp *EventResponse) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func (jsonCodec) DecodeResponse(data []byte) (*EventResponse, error) {
+	ret := &EventResponse{}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, ErrInvalidResponse
+	}
+	return ret, nil
+}
+
+// MsgpackCodec return Codec of MessagePack envelope
+func MsgpackCodec() Codec {
+	return msgpackCodec{}
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) EncodeEvent(event *EventMessage) ([]byte, error) {
+	return msgpack.Marshal(event)
+}
+
+func (msgpackCodec) DecodeEvent(data []byte) (*EventMessage, error) {
+	ret := &EventMessage{}
+	if err := msgpack.Unmarshal(data, ret); err != nil {
+		return nil, ErrInvalidEvent
+	}
+	return ret, nil
+}
+
+func (msgpackCodec) EncodeResponse(resp *EventResponse) ([]byte, error) {
+	return msgpack.Marshal(resp)
+}
+
+func (msgpackCodec) DecodeResponse(data []byte) (*EventResponse, error) {
+	ret := &EventResponse{}
+	if err := msgpack.Unmarshal(data, ret); err != nil {
+		return nil, ErrInvalidResponse
+	}
+	return ret, nil
+}
+
+// ProtobufCodec return Codec of protobuf envelope. Messages are:
+//
+//	message Event {
+//	  int64 id = 1;
+//	  string token = 2;
+//	  string category = 3;
+//	  string service = 4;
+//	  bytes params = 5;
+//	  string caller = 6;
+//	  int64 timestamp = 7;
+//	  string nonce = 8;
+//	  string keyid = 9;
+//	  map<string, string> headers = 10;
+//	}
+//
+//	message Response {
+//	  int64 id = 1;
+//	  bytes message = 2;
+//	  string error_code = 3;
+//	  string error_message = 4;
+//	  map<string, string> headers = 5;
+//	}
+//
+// Response without error_code is success response.
+func ProtobufCodec() Codec {
+	return protobufCodec{}
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) EncodeEvent(event *EventMessage) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, 1, uint64(event.ID))
+	b = appendBytes(b, 2, []byte(event.Token))
+	b = appendBytes(b, 3, []byte(event.Category))
+	b = appendBytes(b, 4, []byte(event.Service))
+	b = appendBytes(b, 5, event.Params)
+	b = appendBytes(b, 6, []byte(event.Caller))
+	b = appendVarint(b, 7, uint64(event.Timestamp))
+	b = appendBytes(b, 8, []byte(event.Nonce))
+	b = appendBytes(b, 9, []byte(event.KeyID))
+	b = appendHeaders(b, 10, event.Headers)
+	return b, nil
+}
+
+func (protobufCodec) DecodeEvent(data []byte) (*EventMessage, error) {
+	ret := &EventMessage{}
+	err := consumeFields(data, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			ret.ID = int(int64(v))
+		case 2:
+			ret.Token = string(b)
+		case 3:
+			ret.Category = string(b)
+		case 4:
+			ret.Service = string(b)
+		case 5:
+			ret.Params = append([]byte{}, b...)
+		case 6:
+			ret.Caller = string(b)
+		case 7:
+			ret.Timestamp = int64(v)
+		case 8:
+			ret.Nonce = string(b)
+		case 9:
+			ret.KeyID = string(b)
+		case 10:
+			if ret.Headers == nil {
+				ret.Headers = make(map[string]string)
+			}
+			return consumeHeader(b, ret.Headers)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, ErrInvalidEvent
+	}
+	return ret, nil
+}
+
+func (protobufCodec) EncodeResponse(resp *EventResponse) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, 1, uint64(resp.ID))
+	b = appendBytes(b, 2, resp.Message)
+	if resp.Error != nil {
+		// error_code is always written to mark error response
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, resp.Error.Code)
+		b = appendBytes(b, 4, []byte(resp.Error.Message))
+	}
+	b = appendHeaders(b, 5, resp.Headers)
+	return b, nil
+}
+
+func (protobufCodec) DecodeResponse(data []byte) (*EventResponse, error) {
+	ret := &EventResponse{}
+	var rerr *RemoteError
+	err := consumeFields(data, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			ret.ID = int(int64(v))
+		case 2:
+			ret.Message = append([]byte{}, b...)
+		case 3:
+			if rerr == nil {
+				rerr = &RemoteError{}
+			}
+			rerr.Code = string(b)
+		case 4:
+			if rerr == nil {
+				rerr = &RemoteError{}
+			}
+			rerr.Message = string(b)
+		case 5:
+			if ret.Headers == nil {
+				ret.Headers = make(map[string]string)
+			}
+			return consumeHeader(b, ret.Headers)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	if rerr != nil && rerr.Code == "" {
+		rerr.Code = ErrCodeServiceError
+	}
+	ret.Error = rerr
+	return ret, nil
+}
+
+// appendVarint append varint field, zero value is omitted as proto3 does
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendBytes append bytes field, empty value is omitted as proto3 does
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendHeaders append headers as map field sorted by name
+func appendHeaders(b []byte, num protowire.Number, headers map[string]string) []byte {
+	for _, name := range sortedKeys(headers) {
+		var entry []byte
+		entry = appendBytes(entry, 1, []byte(name))
+		entry = appendBytes(entry, 2, []byte(headers[name]))
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// consumeHeader read a map entry of headers
+func consumeHeader(data []byte, headers map[string]string) error {
+	var name, value string
+	err := consumeFields(data, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			name = string(b)
+		case 2:
+			value = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	headers[name] = value
+	return nil
+}
+
+// consumeFields call fn with every varint and bytes field in data, fields
+// of other types are skipped. It stops at first error returned by fn.
+func consumeFields(data []byte, fn func(num protowire.Number, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := fn(num, v, nil); err != nil {
+				return err
+			}
+			data = data[n:]
+		case protowire.BytesType:
+			b, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := fn(num, 0, b); err != nil {
+				return err
+			}
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package servicebus
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testCodecs = []Codec{XMLCodec(), JSONCodec(), MsgpackCodec(), ProtobufCodec()}
+
+func TestCodecEventRoundTrip(t *testing.T) {
+	events := []*EventMessage{
+		{ID: 1, Params: []byte{}},
+		{
+			ID:        42,
+			Token:     "token",
+			Category:  "math",
+			Service:   "add",
+			Params:    []byte("[1, 2]\r\n"),
+			Caller:    "Node2",
+			Timestamp: 1700000000,
+			Nonce:     "nonce",
+			KeyID:     "key",
+			Headers:   map[string]string{"trace-id": "abc", "empty": ""},
+		},
+	}
+	for _, codec := range testCodecs {
+		for _, event := range events {
+			data, err := codec.EncodeEvent(event)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.ContentType(), err)
+			}
+			decoded, err := codec.DecodeEvent(data)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.ContentType(), err)
+			}
+			if len(decoded.Params) == 0 {
+				decoded.Params = []byte{}
+			}
+			if len(decoded.Headers) == 0 {
+				decoded.Headers = event.Headers
+			}
+			if !reflect.DeepEqual(decoded, event) {
+				t.Fatalf("%s: event %+v decoded as %+v", codec.ContentType(), event, decoded)
+			}
+		}
+	}
+}
+
+func TestCodecResponseRoundTrip(t *testing.T) {
+	responses := []*EventResponse{
+		{ID: 1, Message: []byte("3")},
+		{ID: 2, Message: []byte{}, Error: NewRemoteError(ErrCodeServiceError, "failed")},
+		{ID: 3, Message: []byte{}, Error: NewRemoteError("", "")},
+		{ID: 4, Message: []byte("ok"), Headers: map[string]string{"server": "Node1"}},
+	}
+	for _, codec := range testCodecs {
+		for _, resp := range responses {
+			data, err := codec.EncodeResponse(resp)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.ContentType(), err)
+			}
+			decoded, err := codec.DecodeResponse(data)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.ContentType(), err)
+			}
+			if decoded.ID != resp.ID || string(decoded.Message) != string(resp.Message) {
+				t.Fatalf("%s: response %+v decoded as %+v", codec.ContentType(), resp, decoded)
+			}
+			if len(resp.Headers) > 0 && !reflect.DeepEqual(decoded.Headers, resp.Headers) {
+				t.Fatalf("%s: headers %v decoded as %v", codec.ContentType(), resp.Headers, decoded.Headers)
+			}
+			if (decoded.Error == nil) != (resp.Error == nil) {
+				t.Fatalf("%s: error %v decoded as %v", codec.ContentType(), resp.Error, decoded.Error)
+			}
+			if resp.Error != nil && decoded.Error.Message != resp.Error.Message {
+				t.Fatalf("%s: error %v decoded as %v", codec.ContentType(), resp.Error, decoded.Error)
+			}
+		}
+	}
+}
+
+func TestCodecInvalidData(t *testing.T) {
+	data := []byte{0xff, 0xff, 0xff}
+	for _, codec := range testCodecs {
+		if _, err := codec.DecodeEvent(data); err != ErrInvalidEvent {
+			t.Errorf("%s: got error %v, want %v", codec.ContentType(), err, ErrInvalidEvent)
+		}
+		if _, err := codec.DecodeResponse(data); err != ErrInvalidResponse {
+			t.Errorf("%s: got error %v, want %v", codec.ContentType(), err, ErrInvalidResponse)
+		}
+	}
+}
+
+type testCodec struct {
+	Codec
+}
+
+func (testCodec) ContentType() string {
+	return "application/x-test"
+}
+
+func TestCodecFor(t *testing.T) {
+	for _, codec := range testCodecs {
+		ret, err := codecFor(codec.ContentType())
+		if err != nil || ret.ContentType() != codec.ContentType() {
+			t.Fatalf("codecFor(%q) = %v, %v", codec.ContentType(), ret, err)
+		}
+	}
+	if ret, err := codecFor(""); err != nil || ret.ContentType() != ContentTypeXML {
+		t.Fatalf("codecFor(\"\") = %v, %v", ret, err)
+	}
+	if _, err := codecFor("application/x-test"); err != ErrUnknownCodec {
+		t.Fatalf("got error %v, want %v", err, ErrUnknownCodec)
+	}
+	RegisterCodec(testCodec{JSONCodec()})
+	defer func() {
+		codecLock.Lock()
+		delete(codecs, "application/x-test")
+		codecLock.Unlock()
+	}()
+	if ret, err := codecFor("application/x-test"); err != nil || ret.ContentType() != "application/x-test" {
+		t.Fatalf("registered codec is not found: %v, %v", ret, err)
+	}
+}
+
+func TestCallWithCodecs(t *testing.T) {
+	broker := newFakeBroker(t)
+	startEchoServer(t, broker)
+	for _, codec := range testCodecs {
+		config := broker.Config()
+		config.Codec = codec
+		sender := NewSender(config)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ret, err := CallTyped[string, string](ctx, sender, "Node1.test.echo", codec.ContentType())
+		cancel()
+		sender.Close()
+		if err != nil || ret != codec.ContentType() {
+			t.Fatalf("%s: got %q, %v", codec.ContentType(), ret, err)
+		}
+	}
+}
+
+// headerService reply headers of request as response headers
+type headerService struct{}
+
+func (headerService) IsBackground() bool {
+	return false
+}
+
+func (headerService) OnMessage(req Request) error {
+	return nil
+}
+
+func (headerService) OnCall(req Request, resp Response) error {
+	for name, value := range req.Headers() {
+		resp.SetHeader("echo-"+name, value)
+	}
+	return resp.SendString(req.Header("trace-id"))
+}
+
+func TestHeadersWithCodecs(t *testing.T) {
+	broker := newFakeBroker(t)
+	server := NewServer(broker.Config())
+	server.RegisterService("test", "header", headerService{})
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	for _, codec := range testCodecs {
+		config := broker.Config()
+		config.Codec = codec
+		sender := NewSender(config)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		replyHeaders := map[string]string{}
+		ret, err := sender.CallContext(ctx, "Node1.test.header", []byte("request"),
+			WithHeader("trace-id", "abc"), WithHeader("tenant", "t1 <&>"), WithReplyHeaders(replyHeaders))
+		cancel()
+		sender.Close()
+		if err != nil || string(ret) != "abc" {
+			t.Fatalf("%s: got %q, %v", codec.ContentType(), ret, err)
+		}
+		want := map[string]string{"echo-trace-id": "abc", "echo-tenant": "t1 <&>"}
+		if !reflect.DeepEqual(replyHeaders, want) {
+			t.Fatalf("%s: reply headers %v, want %v", codec.ContentType(), replyHeaders, want)
+		}
+	}
+}
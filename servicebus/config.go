@@ -2,19 +2,179 @@ package servicebus
 
 import (
 	"crypto/sha1"
+	"crypto/tls"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// AckMode decide when a received message is acknowledged
+type AckMode int
+
+const (
+	// AckOnReceive ack message as soon as it is received, before processing
+	AckOnReceive AckMode = iota
+	// AckAfterSuccess ack message after service processed it successfully.
+	// If service returns error or panics, message is rejected without requeue.
+	AckAfterSuccess
+	// AckRequeueOnFailure ack message after service processed it successfully.
+	// If service returns error or panics, message is requeued for redelivery.
+	// RPC request whose error was replied to caller is rejected without
+	// requeue instead.
+	AckRequeueOnFailure
 )
 
 // Config is configuration for create a client to RabbitMQ server.
 type Config struct {
-	Hosts        []string
+	// Hosts is broker addresses in host or host:port format
+	Hosts []string
+	// URIs is broker AMQP URIs, used instead of Hosts if not empty
+	URIs []string
+	// Port is broker port for Hosts without port, default is 5672 or
+	// 5671 if UseSSL is true
+	Port int
+	// VHost is virtual host on broker, default is "/"
+	VHost        string
 	User         string
 	Password     string
 	UseSSL       bool
 	ExchangeName string
 	NodeName     string
 	SecretToken  string
+	// ChannelPoolSize is max idle AMQP channels kept for publishing per
+	// connection, 0 means use default size
+	ChannelPoolSize int
+	// HostSelector choose host for sending messages, nil means
+	// FirstHealthySelector
+	HostSelector HostSelector
+	// PingBeforeSend make Sender ping target before every Send and Call,
+	// hosts not answering ping are skipped
+	PingBeforeSend bool
+	// Base64Params make Sender encode params in base64, replies are encoded
+	// in the same way. Params not valid in XML are always base64 encoded.
+	// Keep it false if receivers are py-servicebus.
+	Base64Params bool
+	// Codec encode messages of Sender, nil means XMLCodec. Server decode
+	// messages by their ContentType, so it accept all registered codecs.
+	// Receivers of py-servicebus only accept XMLCodec.
+	Codec Codec
+	// AckMode decide when Server acknowledge received messages
+	AckMode AckMode
+	// PrefetchCount is max unacknowledged messages server delivers to a
+	// receiver, 0 means no limit
+	PrefetchCount int
+	// PrefetchSize is max unacknowledged message bytes server delivers to a
+	// receiver, 0 means no limit
+	PrefetchSize int
+	// ConsumerTag is tag prefix of receiver's consumer, default is NodeName
+	ConsumerTag string
+	// ExclusiveConsumer make receiver the only consumer of NodeName queue
+	ExclusiveConsumer bool
+	// ConsumerPriority is receiver's consumer priority, consumers with
+	// higher priority receive messages first
+	ConsumerPriority int
+	// TLSConfig is TLS configuration for amqps connections, such as CA
+	// bundle, client certificates and server name. It requires UseSSL or
+	// amqps URIs
+	TLSConfig *tls.Config
+	// ExternalAuth use SASL EXTERNAL authentication by TLS client certificate
+	// instead of User and Password
+	ExternalAuth bool
+	// Heartbeat is connection heartbeat interval, 0 means 10 seconds
+	Heartbeat time.Duration
+	// DialTimeout is timeout for connecting to broker, 0 means 30 seconds
+	DialTimeout time.Duration
+	// AuthMode decide how messages are signed and validated, default is
+	// AuthToken which is compatible with py-servicebus
+	AuthMode AuthMode
+	// MaxClockSkew is allowed difference between message timestamp and
+	// server time for AuthHMAC, 0 means 5 minutes
+	MaxClockSkew time.Duration
+	// SecretKeys is accepted verification keys by key ID, used with
+	// SecretToken for key rotation. SecretToken's key ID is DefaultKeyID.
+	SecretKeys map[string]string
+	// SigningKeyID is ID of key in SecretKeys for signing messages, if
+	// empty SecretToken is used
+	SigningKeyID string
+	// Interceptors wrap Call, Send and Ping of Senders created from this
+	// Config, first one is outermost
+	Interceptors []Interceptor
+	// RetryPolicy retry failed Sender operations, nil means no retry
+	RetryPolicy *RetryPolicy
+	// CircuitBreaker enable circuit breakers per target and per broker host
+	// for Senders, nil means disabled
+	CircuitBreaker *BreakerConfig
+}
+
+// DefaultKeyID is key ID of Config.SecretToken
+const DefaultKeyID = "default"
+
+// endpoints return brokers to connect, URIs has higher priority than Hosts
+func (c *Config) endpoints() []string {
+	if len(c.URIs) > 0 {
+		return c.URIs
+	}
+	return c.Hosts
+}
+
+// Validate check Config has required fields and valid values
+func (c *Config) Validate() error {
+	endpoints := c.endpoints()
+	if len(endpoints) == 0 {
+		return fmt.Errorf("%w: Hosts and URIs are empty", ErrInvalidConfig)
+	}
+	for _, endpoint := range endpoints {
+		if strings.TrimSpace(endpoint) == "" {
+			return fmt.Errorf("%w: empty host in Hosts or URIs", ErrInvalidConfig)
+		}
+		if isURI(endpoint) {
+			if _, err := amqp.ParseURI(endpoint); err != nil {
+				return fmt.Errorf("%w: URI %q: %v", ErrInvalidConfig, endpoint, err)
+			}
+		}
+	}
+	if c.NodeName == "" {
+		return fmt.Errorf("%w: NodeName is empty", ErrInvalidConfig)
+	}
+	if c.SecretToken == "" && len(c.SecretKeys) == 0 {
+		return fmt.Errorf("%w: SecretToken and SecretKeys are empty", ErrInvalidConfig)
+	}
+	if c.SigningKeyID != "" {
+		if _, have := c.SecretKeys[c.SigningKeyID]; !have {
+			return fmt.Errorf("%w: SigningKeyID %q not in SecretKeys", ErrInvalidConfig, c.SigningKeyID)
+		}
+	} else if c.SecretToken == "" {
+		return fmt.Errorf("%w: SigningKeyID is required when SecretToken is empty", ErrInvalidConfig)
+	}
+	for keyID, secret := range c.SecretKeys {
+		if keyID == "" || secret == "" {
+			return fmt.Errorf("%w: empty key ID or secret in SecretKeys", ErrInvalidConfig)
+		}
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("%w: Port %d out of range", ErrInvalidConfig, c.Port)
+	}
+	if c.ChannelPoolSize < 0 || c.PrefetchCount < 0 || c.PrefetchSize < 0 {
+		return fmt.Errorf("%w: ChannelPoolSize, PrefetchCount and PrefetchSize can not be negative", ErrInvalidConfig)
+	}
+	if c.Heartbeat < 0 || c.DialTimeout < 0 || c.MaxClockSkew < 0 {
+		return fmt.Errorf("%w: Heartbeat, DialTimeout and MaxClockSkew can not be negative", ErrInvalidConfig)
+	}
+	if c.ExternalAuth && c.TLSConfig == nil {
+		return fmt.Errorf("%w: ExternalAuth requires TLSConfig with client certificate", ErrInvalidConfig)
+	}
+	if c.TLSConfig != nil || c.ExternalAuth {
+		// TLSConfig is ignored by amqp connections, do not send credentials
+		// in plaintext silently
+		for _, endpoint := range endpoints {
+			if !isTLSEndpoint(endpoint, c) {
+				return fmt.Errorf("%w: TLSConfig and ExternalAuth require amqps, set UseSSL or use amqps URI for %q", ErrInvalidConfig, endpoint)
+			}
+		}
+	}
+	return nil
 }
 
 // CreateSender create smart sender instance
@@ -28,6 +188,11 @@ func (c *Config) CreateServer() *Server {
 }
 
 func (c *Config) generateToken(date string) string {
+	_, secret := c.signingKey()
+	return generateToken(secret, date)
+}
+
+func generateToken(secret string, date string) string {
 	var dstr string
 	now := time.Now()
 	dayDur := 24 * time.Hour
@@ -44,17 +209,46 @@ func (c *Config) generateToken(date string) string {
 		year, month, day := next.Year(), int(next.Month()), next.Day()
 		dstr = fmt.Sprintf("%4d-%02d-%02d", year, month, day)
 	}
-	tokenStr := fmt.Sprintf("%s - %s", c.SecretToken, dstr)
+	tokenStr := fmt.Sprintf("%s - %s", secret, dstr)
 	return fmt.Sprintf("%x", sha1.Sum([]byte(tokenStr)))
 }
 
-func (c *Config) validateToken(token string) bool {
+// validateToken try every verification key, return ID of key matched token
+func (c *Config) validateToken(token string) (string, bool) {
 	dates := []string{"now", "prev", "next"}
-	for _, date := range dates {
-		gtoken := c.generateToken(date)
-		if token == gtoken {
-			return true
+	for keyID, secret := range c.verificationKeys() {
+		for _, date := range dates {
+			gtoken := generateToken(secret, date)
+			if token == gtoken {
+				return keyID, true
+			}
 		}
 	}
-	return false
+	return "", false
+}
+
+// signingKey return ID and secret of key for signing messages
+func (c *Config) signingKey() (string, string) {
+	if c.SigningKeyID != "" {
+		if secret, have := c.SecretKeys[c.SigningKeyID]; have {
+			return c.SigningKeyID, secret
+		}
+	}
+	return DefaultKeyID, c.SecretToken
+}
+
+// verificationKeys return all accepted keys by key ID, SecretToken is
+// accepted as DefaultKeyID
+func (c *Config) verificationKeys() map[string]string {
+	if len(c.SecretKeys) == 0 {
+		return map[string]string{DefaultKeyID: c.SecretToken}
+	}
+	keys := make(map[string]string, len(c.SecretKeys)+1)
+	if c.SecretToken != "" {
+		keys[DefaultKeyID] = c.SecretToken
+	}
+	for keyID, secret := range c.SecretKeys {
+		keys[keyID] = secret
+	}
+	return keys
 }
@@ -0,0 +1,50 @@
+package servicebus
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// ErrCodeServiceError means service returned an error
+	ErrCodeServiceError = "SERVICE_ERROR"
+	// ErrCodePanic means service panicked
+	ErrCodePanic = "PANIC"
+	// ErrCodeEmptyResponse means service returned without sending response
+	ErrCodeEmptyResponse = "EMPTY_RESPONSE"
+	// ErrCodeBusy means service queue is full and request is rejected
+	ErrCodeBusy = "BUSY"
+	// ErrCodeForbidden means caller is not allowed to call service
+	ErrCodeForbidden = "FORBIDDEN"
+	// ErrCodeBadRequest means request payload can not be decoded by service
+	ErrCodeBadRequest = "BAD_REQUEST"
+)
+
+// RemoteError is error replied by remote service.
+// Service can return a *RemoteError from OnCall to choose error code,
+// other errors are replied with ErrCodeServiceError.
+type RemoteError struct {
+	Code    string `json:"code" msgpack:"code"`
+	Message string `json:"message" msgpack:"message"`
+}
+
+// NewRemoteError create a RemoteError
+func NewRemoteError(code, message string) *RemoteError {
+	return &RemoteError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// toRemoteError convert service returned error to RemoteError
+func toRemoteError(err error) *RemoteError {
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+	return NewRemoteError(ErrCodeServiceError, err.Error())
+}
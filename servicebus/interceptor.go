@@ -0,0 +1,146 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrPingFailed = errors.New("Ping failed")
+)
+
+// CallKind is kind of Sender operation
+type CallKind int
+
+const (
+	KindPing CallKind = iota
+	KindSend
+	KindCall
+)
+
+func (k CallKind) String() string {
+	switch k {
+	case KindPing:
+		return "Ping"
+	case KindSend:
+		return "Send"
+	case KindCall:
+		return "Call"
+	}
+	return "Unknown"
+}
+
+// ClientCall is a Sender operation passed through interceptors
+type ClientCall struct {
+	Kind   CallKind
+	Target string
+	// Params is message to send, it is empty for KindPing
+	Params []byte
+	// Result is RPC response, it is set after KindCall succeeded
+	Result []byte
+	// MessageID is AMQP MessageId of message, it is kept by retries so
+	// services can deduplicate retried messages
+	MessageID string
+	// Idempotent means call can be retried after it was published
+	Idempotent bool
+	// Headers are sent with message, service read them by Request.Header
+	Headers map[string]string
+	// ReplyHeaders are headers set by service, it is set after KindCall
+	// got response
+	ReplyHeaders map[string]string
+	// replyHeaders is map to receive ReplyHeaders, see WithReplyHeaders
+	replyHeaders map[string]string
+	// published is set once message is published to broker
+	published bool
+	// payloadCodec is used by CallTyped
+	payloadCodec PayloadCodec
+}
+
+// Published report whether message of call was published to broker. A
+// published non-idempotent call is never retried.
+func (c *ClientCall) Published() bool {
+	return c.published
+}
+
+// CallOption set options of a Sender operation
+type CallOption func(*ClientCall)
+
+// Idempotent mark call safe to retry after it was published
+func Idempotent() CallOption {
+	return func(call *ClientCall) {
+		call.Idempotent = true
+	}
+}
+
+// WithMessageID set AMQP MessageId of message, default is a random UUID
+func WithMessageID(id string) CallOption {
+	return func(call *ClientCall) {
+		call.MessageID = id
+	}
+}
+
+// WithHeader set header of message
+func WithHeader(name, value string) CallOption {
+	return func(call *ClientCall) {
+		if call.Headers == nil {
+			call.Headers = make(map[string]string)
+		}
+		call.Headers[name] = value
+	}
+}
+
+// WithHeaders set headers of message
+func WithHeaders(headers map[string]string) CallOption {
+	return func(call *ClientCall) {
+		for name, value := range headers {
+			WithHeader(name, value)(call)
+		}
+	}
+}
+
+// WithReplyHeaders copy headers of RPC response to dst, dst must not be nil
+func WithReplyHeaders(dst map[string]string) CallOption {
+	return func(call *ClientCall) {
+		call.replyHeaders = dst
+	}
+}
+
+func (c *ClientCall) setReplyHeaders(headers map[string]string) {
+	c.ReplyHeaders = headers
+	if c.replyHeaders == nil {
+		return
+	}
+	for name, value := range headers {
+		c.replyHeaders[name] = value
+	}
+}
+
+func newClientCall(kind CallKind, target string, message []byte, opts []CallOption) *ClientCall {
+	call := &ClientCall{
+		Kind:      kind,
+		Target:    target,
+		Params:    message,
+		MessageID: newUUID(),
+	}
+	for _, opt := range opts {
+		opt(call)
+	}
+	return call
+}
+
+// Invoker execute a ClientCall. For KindPing, nil error means target
+// answered ping.
+type Invoker func(ctx context.Context, call *ClientCall) error
+
+// Interceptor wrap an Invoker to add behaviors such as logging, metrics or
+// circuit breaking around Sender operations. Innermost invoker selects host
+// and sends message.
+type Interceptor func(next Invoker) Invoker
+
+// chainInterceptors wrap invoker by interceptors, first one is outermost
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		invoker = interceptors[i](invoker)
+	}
+	return invoker
+}
@@ -0,0 +1,105 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// observedCall is ClientCall seen by interceptor after next returned
+type observedCall struct {
+	Kind   CallKind
+	Target string
+	Result string
+	Err    error
+}
+
+func TestInterceptors(t *testing.T) {
+	broker := newFakeBroker(t)
+	server := NewServer(broker.Config())
+	server.RegisterService("test", "count", &countService{})
+	server.RegisterService("test", "fail", &failService{})
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+
+	var lock sync.Mutex
+	var order []string
+	var observed []observedCall
+	record := func(name string) Interceptor {
+		return func(next Invoker) Invoker {
+			return func(ctx context.Context, call *ClientCall) error {
+				lock.Lock()
+				order = append(order, name+" in")
+				lock.Unlock()
+				err := next(ctx, call)
+				lock.Lock()
+				order = append(order, name+" out")
+				lock.Unlock()
+				return err
+			}
+		}
+	}
+	observe := func(next Invoker) Invoker {
+		return func(ctx context.Context, call *ClientCall) error {
+			err := next(ctx, call)
+			lock.Lock()
+			observed = append(observed, observedCall{call.Kind, call.Target, string(call.Result), err})
+			lock.Unlock()
+			return err
+		}
+	}
+	config := broker.Config()
+	config.Interceptors = []Interceptor{record("first"), record("second"), observe}
+	sender := NewSender(config)
+	defer sender.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := sender.CallContext(ctx, "Node1.test.count", []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	got := order
+	lock.Unlock()
+	want := []string{"first in", "second in", "second out", "first out"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("interceptors run in order %v, want %v", got, want)
+	}
+
+	_, callErr := sender.CallContext(ctx, "Node1.test.fail", []byte("request"))
+	var rerr *RemoteError
+	if !errors.As(callErr, &rerr) {
+		t.Fatalf("got error %v, want RemoteError", callErr)
+	}
+	if err := sender.SendContext(ctx, "Node1.test.count", []byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	if !sender.PingContext(ctx, "Node1.test.count") {
+		t.Fatal("ping failed")
+	}
+	if sender.PingContext(ctx, "invalid") {
+		t.Fatal("ping invalid target succeeded")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	wantObserved := []observedCall{
+		{KindCall, "Node1.test.count", "ok", nil},
+		{KindCall, "Node1.test.fail", "", callErr},
+		{KindSend, "Node1.test.count", "", nil},
+		{KindPing, "Node1.test.count", "", nil},
+		{KindPing, "invalid", "", ErrPingFailed},
+	}
+	if !reflect.DeepEqual(observed, wantObserved) {
+		t.Fatalf("interceptor observed %+v, want %+v", observed, wantObserved)
+	}
+}
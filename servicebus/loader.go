@@ -0,0 +1,418 @@
+package servicebus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrInvalidConfig = errors.New("Invalid config")
+	envPattern       = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// fileConfig is Config in configuration file and environment variable format.
+// Environment variable name is prefix + "_" + upper case of json tag.
+type fileConfig struct {
+	Hosts                 []string          `json:"hosts" yaml:"hosts" toml:"hosts"`
+	URIs                  []string          `json:"uris" yaml:"uris" toml:"uris"`
+	Port                  int               `json:"port" yaml:"port" toml:"port"`
+	VHost                 string            `json:"vhost" yaml:"vhost" toml:"vhost"`
+	User                  string            `json:"user" yaml:"user" toml:"user"`
+	Password              string            `json:"password" yaml:"password" toml:"password"`
+	PasswordFile          string            `json:"password_file" yaml:"password_file" toml:"password_file"`
+	UseSSL                bool              `json:"use_ssl" yaml:"use_ssl" toml:"use_ssl"`
+	ExchangeName          string            `json:"exchange_name" yaml:"exchange_name" toml:"exchange_name"`
+	NodeName              string            `json:"node_name" yaml:"node_name" toml:"node_name"`
+	SecretToken           string            `json:"secret_token" yaml:"secret_token" toml:"secret_token"`
+	SecretTokenFile       string            `json:"secret_token_file" yaml:"secret_token_file" toml:"secret_token_file"`
+	ChannelPoolSize       int               `json:"channel_pool_size" yaml:"channel_pool_size" toml:"channel_pool_size"`
+	HostSelector          string            `json:"host_selector" yaml:"host_selector" toml:"host_selector"`
+	PingBeforeSend        bool              `json:"ping_before_send" yaml:"ping_before_send" toml:"ping_before_send"`
+	Base64Params          bool              `json:"base64_params" yaml:"base64_params" toml:"base64_params"`
+	Codec                 string            `json:"codec" yaml:"codec" toml:"codec"`
+	AckMode               string            `json:"ack_mode" yaml:"ack_mode" toml:"ack_mode"`
+	PrefetchCount         int               `json:"prefetch_count" yaml:"prefetch_count" toml:"prefetch_count"`
+	PrefetchSize          int               `json:"prefetch_size" yaml:"prefetch_size" toml:"prefetch_size"`
+	ConsumerTag           string            `json:"consumer_tag" yaml:"consumer_tag" toml:"consumer_tag"`
+	ExclusiveConsumer     bool              `json:"exclusive_consumer" yaml:"exclusive_consumer" toml:"exclusive_consumer"`
+	ConsumerPriority      int               `json:"consumer_priority" yaml:"consumer_priority" toml:"consumer_priority"`
+	TLSCAFile             string            `json:"tls_ca_file" yaml:"tls_ca_file" toml:"tls_ca_file"`
+	TLSCertFile           string            `json:"tls_cert_file" yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile            string            `json:"tls_key_file" yaml:"tls_key_file" toml:"tls_key_file"`
+	TLSServerName         string            `json:"tls_server_name" yaml:"tls_server_name" toml:"tls_server_name"`
+	TLSInsecureSkipVerify bool              `json:"tls_insecure_skip_verify" yaml:"tls_insecure_skip_verify" toml:"tls_insecure_skip_verify"`
+	ExternalAuth          bool              `json:"external_auth" yaml:"external_auth" toml:"external_auth"`
+	Heartbeat             string            `json:"heartbeat" yaml:"heartbeat" toml:"heartbeat"`
+	DialTimeout           string            `json:"dial_timeout" yaml:"dial_timeout" toml:"dial_timeout"`
+	AuthMode              string            `json:"auth_mode" yaml:"auth_mode" toml:"auth_mode"`
+	MaxClockSkew          string            `json:"max_clock_skew" yaml:"max_clock_skew" toml:"max_clock_skew"`
+	SecretKeys            map[string]string `json:"secret_keys" yaml:"secret_keys" toml:"secret_keys"`
+	SigningKeyID          string            `json:"signing_key_id" yaml:"signing_key_id" toml:"signing_key_id"`
+	RetryMaxAttempts      int               `json:"retry_max_attempts" yaml:"retry_max_attempts" toml:"retry_max_attempts"`
+	RetryInitialBackoff   string            `json:"retry_initial_backoff" yaml:"retry_initial_backoff" toml:"retry_initial_backoff"`
+	RetryMaxBackoff       string            `json:"retry_max_backoff" yaml:"retry_max_backoff" toml:"retry_max_backoff"`
+	RetryJitter           float64           `json:"retry_jitter" yaml:"retry_jitter" toml:"retry_jitter"`
+	RetryAttemptTimeout   string            `json:"retry_attempt_timeout" yaml:"retry_attempt_timeout" toml:"retry_attempt_timeout"`
+	RetrySwitchHost       bool              `json:"retry_switch_host" yaml:"retry_switch_host" toml:"retry_switch_host"`
+	BreakerEnabled        bool              `json:"breaker_enabled" yaml:"breaker_enabled" toml:"breaker_enabled"`
+	BreakerThreshold      int               `json:"breaker_threshold" yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerOpenTimeout    string            `json:"breaker_open_timeout" yaml:"breaker_open_timeout" toml:"breaker_open_timeout"`
+	BreakerHalfOpen       int               `json:"breaker_half_open" yaml:"breaker_half_open" toml:"breaker_half_open"`
+}
+
+// LoadConfig load Config from YAML, JSON or TOML file, format is decided by
+// file extension. ${ENV} in string values is replaced by environment
+// variable's value after parsing, unset variable is an error. Returned Config
+// is validated.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc := &fileConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, fc)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, fc)
+	case ".toml":
+		err = toml.Unmarshal(data, fc)
+	default:
+		return nil, fmt.Errorf("%w: unknown file format %q", ErrInvalidConfig, filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+	if err := fc.expandEnv(); err != nil {
+		return nil, err
+	}
+	return fc.toConfig()
+}
+
+// ConfigFromEnv load Config from environment variables. Variable name is
+// prefix and upper case field name joined by "_", such as SERVICEBUS_HOSTS.
+// List values are separated by comma, map values are key=value pairs
+// separated by comma. Returned Config is validated.
+func ConfigFromEnv(prefix string) (*Config, error) {
+	fc := &fileConfig{}
+	value := reflect.ValueOf(fc).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.ToUpper(field.Tag.Get("json"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		env, have := os.LookupEnv(name)
+		if !have {
+			continue
+		}
+		if err := setField(value.Field(i), env); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, name, err)
+		}
+	}
+	return fc.toConfig()
+}
+
+// expandEnv replace ${ENV} in string values of fc with environment
+// variables. It runs after parsing, so values are never parsed as YAML, JSON
+// or TOML. Unset variable is an error.
+func (fc *fileConfig) expandEnv() error {
+	value := reflect.ValueOf(fc).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := value.Type().Field(i).Tag.Get("json")
+		switch field.Kind() {
+		case reflect.String:
+			s, err := expandEnv(name, field.String())
+			if err != nil {
+				return err
+			}
+			field.SetString(s)
+		case reflect.Slice:
+			for j := 0; j < field.Len(); j++ {
+				s, err := expandEnv(name, field.Index(j).String())
+				if err != nil {
+					return err
+				}
+				field.Index(j).SetString(s)
+			}
+		case reflect.Map:
+			for _, key := range field.MapKeys() {
+				s, err := expandEnv(name, field.MapIndex(key).String())
+				if err != nil {
+					return err
+				}
+				field.SetMapIndex(key, reflect.ValueOf(s))
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnv replace ${ENV} in value of field with environment variables
+func expandEnv(field, value string) (string, error) {
+	missing := ""
+	ret := envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := envPattern.FindStringSubmatch(match)[1]
+		env, have := os.LookupEnv(name)
+		if !have && missing == "" {
+			missing = name
+		}
+		return env
+	})
+	if missing != "" {
+		return "", fmt.Errorf("%w: %s: environment variable %s is not set", ErrInvalidConfig, field, missing)
+	}
+	return ret, nil
+}
+
+func setField(field reflect.Value, env string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(env)
+	case reflect.Int:
+		v, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(v))
+	case reflect.Float64:
+		v, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(v)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		field.SetBool(v)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		items := map[string]string{}
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			parts := strings.SplitN(item, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("%q is not key=value", item)
+			}
+			items[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+		field.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+// toConfig convert fileConfig to Config, read secret files and validate it
+func (fc *fileConfig) toConfig() (*Config, error) {
+	c := &Config{
+		Hosts:             fc.Hosts,
+		URIs:              fc.URIs,
+		Port:              fc.Port,
+		VHost:             fc.VHost,
+		User:              fc.User,
+		Password:          fc.Password,
+		UseSSL:            fc.UseSSL,
+		ExchangeName:      fc.ExchangeName,
+		NodeName:          fc.NodeName,
+		SecretToken:       fc.SecretToken,
+		ChannelPoolSize:   fc.ChannelPoolSize,
+		PingBeforeSend:    fc.PingBeforeSend,
+		Base64Params:      fc.Base64Params,
+		PrefetchCount:     fc.PrefetchCount,
+		PrefetchSize:      fc.PrefetchSize,
+		ConsumerTag:       fc.ConsumerTag,
+		ExclusiveConsumer: fc.ExclusiveConsumer,
+		ConsumerPriority:  fc.ConsumerPriority,
+		ExternalAuth:      fc.ExternalAuth,
+		SecretKeys:        fc.SecretKeys,
+		SigningKeyID:      fc.SigningKeyID,
+	}
+	var err error
+	if fc.PasswordFile != "" {
+		if c.Password, err = readSecretFile(fc.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	if fc.SecretTokenFile != "" {
+		if c.SecretToken, err = readSecretFile(fc.SecretTokenFile); err != nil {
+			return nil, err
+		}
+	}
+	switch fc.HostSelector {
+	case "", "first-healthy":
+		c.HostSelector = FirstHealthySelector()
+	case "round-robin":
+		c.HostSelector = RoundRobinSelector()
+	case "random":
+		c.HostSelector = RandomSelector()
+	case "least-outstanding":
+		c.HostSelector = LeastOutstandingSelector()
+	default:
+		return nil, fmt.Errorf("%w: unknown host_selector %q", ErrInvalidConfig, fc.HostSelector)
+	}
+	switch fc.Codec {
+	case "", "xml":
+		c.Codec = XMLCodec()
+	case "json":
+		c.Codec = JSONCodec()
+	case "msgpack":
+		c.Codec = MsgpackCodec()
+	case "protobuf":
+		c.Codec = ProtobufCodec()
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %q", ErrInvalidConfig, fc.Codec)
+	}
+	switch fc.AckMode {
+	case "", "receive":
+		c.AckMode = AckOnReceive
+	case "success":
+		c.AckMode = AckAfterSuccess
+	case "requeue":
+		c.AckMode = AckRequeueOnFailure
+	default:
+		return nil, fmt.Errorf("%w: unknown ack_mode %q", ErrInvalidConfig, fc.AckMode)
+	}
+	switch fc.AuthMode {
+	case "", "token":
+		c.AuthMode = AuthToken
+	case "hmac":
+		c.AuthMode = AuthHMAC
+	default:
+		return nil, fmt.Errorf("%w: unknown auth_mode %q", ErrInvalidConfig, fc.AuthMode)
+	}
+	if c.MaxClockSkew, err = parseDuration("max_clock_skew", fc.MaxClockSkew); err != nil {
+		return nil, err
+	}
+	if c.Heartbeat, err = parseDuration("heartbeat", fc.Heartbeat); err != nil {
+		return nil, err
+	}
+	if c.DialTimeout, err = parseDuration("dial_timeout", fc.DialTimeout); err != nil {
+		return nil, err
+	}
+	if c.TLSConfig, err = fc.tlsConfig(); err != nil {
+		return nil, err
+	}
+	if c.RetryPolicy, err = fc.retryPolicy(); err != nil {
+		return nil, err
+	}
+	if c.CircuitBreaker, err = fc.circuitBreaker(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// tlsConfig build tls.Config from files, nil is returned if no TLS option set
+func (fc *fileConfig) tlsConfig() (*tls.Config, error) {
+	if fc.TLSCAFile == "" && fc.TLSCertFile == "" && fc.TLSKeyFile == "" && fc.TLSServerName == "" && !fc.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+	ret := &tls.Config{
+		ServerName:         fc.TLSServerName,
+		InsecureSkipVerify: fc.TLSInsecureSkipVerify,
+	}
+	if fc.TLSCAFile != "" {
+		data, err := ioutil.ReadFile(fc.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: tls_ca_file: %v", ErrInvalidConfig, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w: tls_ca_file: no certificate found in %s", ErrInvalidConfig, fc.TLSCAFile)
+		}
+		ret.RootCAs = pool
+	}
+	if fc.TLSCertFile != "" || fc.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(fc.TLSCertFile, fc.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: tls_cert_file: %v", ErrInvalidConfig, err)
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+	return ret, nil
+}
+
+// retryPolicy build RetryPolicy, nil is returned if retry is not enabled
+func (fc *fileConfig) retryPolicy() (*RetryPolicy, error) {
+	if fc.RetryMaxAttempts <= 1 {
+		return nil, nil
+	}
+	ret := &RetryPolicy{
+		MaxAttempts: fc.RetryMaxAttempts,
+		Jitter:      fc.RetryJitter,
+		SwitchHost:  fc.RetrySwitchHost,
+	}
+	var err error
+	if ret.InitialBackoff, err = parseDuration("retry_initial_backoff", fc.RetryInitialBackoff); err != nil {
+		return nil, err
+	}
+	if ret.MaxBackoff, err = parseDuration("retry_max_backoff", fc.RetryMaxBackoff); err != nil {
+		return nil, err
+	}
+	if ret.AttemptTimeout, err = parseDuration("retry_attempt_timeout", fc.RetryAttemptTimeout); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// circuitBreaker build BreakerConfig, nil is returned if breaker is not enabled
+func (fc *fileConfig) circuitBreaker() (*BreakerConfig, error) {
+	if !fc.BreakerEnabled {
+		return nil, nil
+	}
+	ret := &BreakerConfig{
+		FailureThreshold: fc.BreakerThreshold,
+		HalfOpenRequests: fc.BreakerHalfOpen,
+	}
+	var err error
+	if ret.OpenTimeout, err = parseDuration("breaker_open_timeout", fc.BreakerOpenTimeout); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func parseDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ret, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, name, err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,223 @@
+package servicebus
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile write content to file name in a temporary directory
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+hosts: [mq1, "mq2:5673"]
+user: guest
+password: guest
+node_name: Node1
+secret_token: secret
+host_selector: round-robin
+codec: protobuf
+ack_mode: requeue
+heartbeat: 30s
+retry_max_attempts: 3
+retry_initial_backoff: 200ms
+breaker_enabled: true
+breaker_threshold: 10
+secret_keys:
+  k2: secret2
+`,
+		"config.json": `{
+  "hosts": ["mq1", "mq2:5673"],
+  "user": "guest",
+  "password": "guest",
+  "node_name": "Node1",
+  "secret_token": "secret",
+  "host_selector": "round-robin",
+  "codec": "protobuf",
+  "ack_mode": "requeue",
+  "heartbeat": "30s",
+  "retry_max_attempts": 3,
+  "retry_initial_backoff": "200ms",
+  "breaker_enabled": true,
+  "breaker_threshold": 10,
+  "secret_keys": {"k2": "secret2"}
+}`,
+		"config.toml": `
+hosts = ["mq1", "mq2:5673"]
+user = "guest"
+password = "guest"
+node_name = "Node1"
+secret_token = "secret"
+host_selector = "round-robin"
+codec = "protobuf"
+ack_mode = "requeue"
+heartbeat = "30s"
+retry_max_attempts = 3
+retry_initial_backoff = "200ms"
+breaker_enabled = true
+breaker_threshold = 10
+
+[secret_keys]
+k2 = "secret2"
+`,
+	}
+	for name, content := range files {
+		config, err := LoadConfig(writeConfigFile(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(config.Hosts, []string{"mq1", "mq2:5673"}) || config.NodeName != "Node1" || config.Password != "guest" {
+			t.Fatalf("%s: unexpected config %+v", name, config)
+		}
+		if _, ok := config.HostSelector.(*roundRobinSelector); !ok {
+			t.Fatalf("%s: unexpected host selector %T", name, config.HostSelector)
+		}
+		if config.Codec.ContentType() != ContentTypeProtobuf || config.AckMode != AckRequeueOnFailure || config.Heartbeat != 30*time.Second {
+			t.Fatalf("%s: unexpected config %+v", name, config)
+		}
+		if config.RetryPolicy == nil || config.RetryPolicy.MaxAttempts != 3 || config.RetryPolicy.InitialBackoff != 200*time.Millisecond {
+			t.Fatalf("%s: unexpected retry policy %+v", name, config.RetryPolicy)
+		}
+		if config.CircuitBreaker == nil || config.CircuitBreaker.FailureThreshold != 10 {
+			t.Fatalf("%s: unexpected circuit breaker %+v", name, config.CircuitBreaker)
+		}
+		if config.SecretKeys["k2"] != "secret2" {
+			t.Fatalf("%s: unexpected secret keys %v", name, config.SecretKeys)
+		}
+	}
+}
+
+func TestLoadConfigExpandEnv(t *testing.T) {
+	// Values which break the file format if they are substituted before
+	// parsing
+	password := `p@ss #word "quoted" 'single' \n = [x]`
+	t.Setenv("SB_TEST_PASSWORD", password)
+	t.Setenv("SB_TEST_HOST", "mq1")
+	t.Setenv("SB_TEST_KEY", "secret2")
+	files := map[string]string{
+		"config.yaml": `
+hosts: ["${SB_TEST_HOST}:5672"]
+password: ${SB_TEST_PASSWORD}
+node_name: Node1
+secret_token: secret
+secret_keys:
+  k2: ${SB_TEST_KEY}
+`,
+		"config.json": `{
+  "hosts": ["${SB_TEST_HOST}:5672"],
+  "password": "${SB_TEST_PASSWORD}",
+  "node_name": "Node1",
+  "secret_token": "secret",
+  "secret_keys": {"k2": "${SB_TEST_KEY}"}
+}`,
+		"config.toml": `
+hosts = ["${SB_TEST_HOST}:5672"]
+password = "${SB_TEST_PASSWORD}"
+node_name = "Node1"
+secret_token = "secret"
+
+[secret_keys]
+k2 = "${SB_TEST_KEY}"
+`,
+	}
+	for name, content := range files {
+		config, err := LoadConfig(writeConfigFile(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if config.Password != password {
+			t.Fatalf("%s: password is %q, want %q", name, config.Password, password)
+		}
+		if config.Hosts[0] != "mq1:5672" || config.SecretKeys["k2"] != "secret2" {
+			t.Fatalf("%s: unexpected config %+v", name, config)
+		}
+	}
+}
+
+func TestLoadConfigUnsetEnv(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+hosts: [mq1]
+node_name: Node1
+secret_token: ${SB_TEST_UNSET}
+`)
+	_, err := LoadConfig(path)
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "SB_TEST_UNSET") {
+		t.Fatalf("got error %v, want ErrInvalidConfig naming SB_TEST_UNSET", err)
+	}
+	// Variable set to empty string is not an error
+	t.Setenv("SB_TEST_EMPTY", "")
+	path = writeConfigFile(t, "config.yaml", `
+hosts: [mq1]
+node_name: Node1${SB_TEST_EMPTY}
+secret_token: secret
+`)
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	files := map[string]string{
+		"config.ini":  "hosts = mq1",
+		"bad.yaml":    "hosts: [",
+		"codec.yaml":  "hosts: [mq1]\nnode_name: Node1\nsecret_token: secret\ncodec: bson\n",
+		"port.yaml":   "hosts: [mq1]\nnode_name: Node1\nsecret_token: secret\nport: 70000\n",
+		"noname.json": `{"hosts": ["mq1"], "secret_token": "secret"}`,
+	}
+	for name, content := range files {
+		if _, err := LoadConfig(writeConfigFile(t, name, content)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: got error %v, want ErrInvalidConfig", name, err)
+		}
+	}
+}
+
+func TestLoadConfigSecretFile(t *testing.T) {
+	secret := writeConfigFile(t, "secret", "file-secret\n")
+	path := writeConfigFile(t, "config.yaml", `
+hosts: [mq1]
+node_name: Node1
+secret_token_file: `+secret+`
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SecretToken != "file-secret" {
+		t.Fatalf("secret token is %q", config.SecretToken)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("SBTEST_HOSTS", "mq1, mq2")
+	t.Setenv("SBTEST_NODE_NAME", "Node1")
+	t.Setenv("SBTEST_SECRET_TOKEN", "secret")
+	t.Setenv("SBTEST_SECRET_KEYS", "k2=secret2, k3=secret3")
+	t.Setenv("SBTEST_PREFETCH_COUNT", "10")
+	t.Setenv("SBTEST_PING_BEFORE_SEND", "true")
+	config, err := ConfigFromEnv("SBTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Hosts, []string{"mq1", "mq2"}) || config.PrefetchCount != 10 || !config.PingBeforeSend {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if !reflect.DeepEqual(config.SecretKeys, map[string]string{"k2": "secret2", "k3": "secret3"}) {
+		t.Fatalf("unexpected secret keys %v", config.SecretKeys)
+	}
+	t.Setenv("SBTEST_PREFETCH_COUNT", "ten")
+	if _, err := ConfigFromEnv("SBTEST"); !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "SBTEST_PREFETCH_COUNT") {
+		t.Fatalf("got error %v, want ErrInvalidConfig naming SBTEST_PREFETCH_COUNT", err)
+	}
+}
@@ -1,11 +1,17 @@
 package servicebus
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/beevik/etree"
 )
@@ -19,55 +25,203 @@ var (
 
 // EventMessage is request message for service bus
 type EventMessage struct {
-	ID       int
-	Token    string
-	Category string
-	Service  string
-	Params   []byte
+	ID       int    `json:"id" msgpack:"id"`
+	Token    string `json:"token" msgpack:"token"`
+	Category string `json:"category" msgpack:"category"`
+	Service  string `json:"service" msgpack:"service"`
+	Params   []byte `json:"params" msgpack:"params"`
+	// Caller is NodeName of sender
+	Caller string `json:"caller,omitempty" msgpack:"caller,omitempty"`
+	// Timestamp, Nonce and KeyID are only used by AuthHMAC, Timestamp is
+	// unix second
+	Timestamp int64  `json:"timestamp,omitempty" msgpack:"timestamp,omitempty"`
+	Nonce     string `json:"nonce,omitempty" msgpack:"nonce,omitempty"`
+	KeyID     string `json:"keyid,omitempty" msgpack:"keyid,omitempty"`
+	// Headers are custom headers set by sender
+	Headers map[string]string `json:"headers,omitempty" msgpack:"headers,omitempty"`
+	// Base64 encode Params in base64, it is always used when Params is
+	// not valid XML text. It is only used by XMLCodec.
+	Base64 bool `json:"-" msgpack:"-"`
 }
 
 // toXML marshal EventMessage to XML format
 func (m *EventMessage) toXML() []byte {
-	xmlTpl := "<?xml version=\"1.0\"?>\n"
-	xmlTpl += "<event version=\"1\">\n"
-	xmlTpl += "  <id>%d</id>\n"
-	xmlTpl += "  <token>%s</token>\n"
-	xmlTpl += "  <catgory>%s</catgory>\n"
-	xmlTpl += "  <service>%s</service>\n"
-	xmlTpl += "  <params><![CDATA[%s]]></params>\n"
-	xmlTpl += "</event>\n"
-
-	return []byte(fmt.Sprintf(
-		xmlTpl,
-		m.ID,
-		m.Token,
-		m.Category,
-		m.Service,
-		string(m.Params),
-	))
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\"?>\n")
+	buf.WriteString("<event version=\"1\">\n")
+	writeElement(&buf, "id", strconv.Itoa(m.ID))
+	writeElement(&buf, "token", m.Token)
+	writeElement(&buf, "catgory", m.Category)
+	writeElement(&buf, "service", m.Service)
+	writeData(&buf, "params", m.Params, m.Base64)
+	if m.Nonce != "" {
+		writeElement(&buf, "timestamp", strconv.FormatInt(m.Timestamp, 10))
+		writeElement(&buf, "nonce", m.Nonce)
+	}
+	if m.KeyID != "" {
+		writeElement(&buf, "keyid", m.KeyID)
+	}
+	if m.Caller != "" {
+		writeElement(&buf, "caller", m.Caller)
+	}
+	writeHeaders(&buf, m.Headers)
+	buf.WriteString("</event>\n")
+	return buf.Bytes()
 }
 
 // EventResponse is response message for service bus
 type EventResponse struct {
-	ID      int
-	Message []byte
+	ID      int    `json:"id" msgpack:"id"`
+	Message []byte `json:"message" msgpack:"message"`
+	// Error is set when service failed, it is nil for success response
+	Error *RemoteError `json:"error,omitempty" msgpack:"error,omitempty"`
+	// Headers are custom headers set by service
+	Headers map[string]string `json:"headers,omitempty" msgpack:"headers,omitempty"`
+	// Base64 encode Message in base64, it is always used when Message is
+	// not valid XML text. It is only used by XMLCodec.
+	Base64 bool `json:"-" msgpack:"-"`
 }
 
 // toXML marshal EventResponse to XML format
 func (m *EventResponse) toXML() []byte {
-	xmlTpl := "<?xml version=\"1.0\"?>\n"
-	xmlTpl += "<response>\n"
-	xmlTpl += "  <id>%d</id>\n"
-	xmlTpl += "  <message><![CDATA[%s]]></message>\n"
-	xmlTpl += "</response>\n"
-	return []byte(fmt.Sprintf(
-		xmlTpl,
-		m.ID,
-		string(m.Message),
-	))
-}
-
-func createEventMessage(target string, token string, msg []byte) (string, *EventMessage, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\"?>\n")
+	buf.WriteString("<response>\n")
+	writeElement(&buf, "id", strconv.Itoa(m.ID))
+	writeData(&buf, "message", m.Message, m.Base64)
+	if m.Error != nil {
+		buf.WriteString("  <error code=\"")
+		xml.EscapeText(&buf, []byte(m.Error.Code))
+		buf.WriteString("\">")
+		xml.EscapeText(&buf, []byte(m.Error.Message))
+		buf.WriteString("</error>\n")
+	}
+	writeHeaders(&buf, m.Headers)
+	buf.WriteString("</response>\n")
+	return buf.Bytes()
+}
+
+// writeElement write element with escaped text
+func writeElement(buf *bytes.Buffer, name, text string) {
+	fmt.Fprintf(buf, "  <%s>", name)
+	xml.EscapeText(buf, []byte(text))
+	fmt.Fprintf(buf, "</%s>\n", name)
+}
+
+// writeHeaders write headers sorted by name, nothing is written if headers
+// is empty
+func writeHeaders(buf *bytes.Buffer, headers map[string]string) {
+	if len(headers) == 0 {
+		return
+	}
+	buf.WriteString("  <headers>\n")
+	for _, name := range sortedKeys(headers) {
+		buf.WriteString("    <header name=\"")
+		xml.EscapeText(buf, []byte(name))
+		buf.WriteString("\">")
+		xml.EscapeText(buf, []byte(headers[name]))
+		buf.WriteString("</header>\n")
+	}
+	buf.WriteString("  </headers>\n")
+}
+
+// readHeaders read headers written by writeHeaders, nil is returned if
+// there is no header
+func readHeaders(root *etree.Element) map[string]string {
+	xheaders := root.SelectElement("headers")
+	if xheaders == nil {
+		return nil
+	}
+	ret := make(map[string]string)
+	for _, xheader := range xheaders.SelectElements("header") {
+		ret[xheader.SelectAttrValue("name", "")] = elementText(xheader)
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// writeData write data as CDATA element, same as py-servicebus. Data is
+// base64 encoded if useBase64 is true or data is not valid XML text.
+func writeData(buf *bytes.Buffer, name string, data []byte, useBase64 bool) {
+	if useBase64 || !isXMLText(data) {
+		fmt.Fprintf(buf, "  <%s encoding=\"base64\">%s</%s>\n", name, base64.StdEncoding.EncodeToString(data), name)
+		return
+	}
+	// "]]>" can not appear in CDATA, split it to two CDATA sections.
+	// Carriage return in CDATA is normalized to line feed by XML parsers, so
+	// it is written as character reference between CDATA sections.
+	cdata := cdataEscaper.Replace(string(data))
+	fmt.Fprintf(buf, "  <%s><![CDATA[%s]]></%s>\n", name, cdata, name)
+}
+
+var cdataEscaper = strings.NewReplacer(
+	"]]>", "]]]]><![CDATA[>",
+	"\r", "]]>&#13;<![CDATA[",
+)
+
+// isXMLText report whether data is valid XML text, which can be written in
+// CDATA
+func isXMLText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+		case r >= 0x20 && r <= 0xD7FF:
+		case r >= 0xE000 && r <= 0xFFFD:
+		case r >= 0x10000 && r <= 0x10FFFF:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// elementText return all character data of element. etree's Text stops at
+// the first child which is not character data, such as a comment.
+func elementText(e *etree.Element) string {
+	var sb strings.Builder
+	for _, t := range e.Child {
+		if cd, ok := t.(*etree.CharData); ok {
+			sb.WriteString(cd.Data)
+		}
+	}
+	return sb.String()
+}
+
+// elementData return data of element written by writeData
+func elementData(e *etree.Element) ([]byte, bool, error) {
+	text := elementText(e)
+	if e.SelectAttrValue("encoding", "") != "base64" {
+		return []byte(text), false, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	return data, true, err
+}
+
+// newUUID return a random UUID (version 4) for message and correlation IDs
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// createEventMessage create event to target. ID is a process local counter
+// kept for py-servicebus, use AMQP MessageId to identify messages.
+func createEventMessage(target string, msg []byte) (string, *EventMessage, error) {
 	parts := strings.Split(target, ".")
 	if len(parts) != 3 {
 		return "", nil, ErrInvalidTarget
@@ -76,7 +230,6 @@ func createEventMessage(target string, token string, msg []byte) (string, *Event
 	queue := parts[0]
 	ret := &EventMessage{
 		ID:       int(id),
-		Token:    token,
 		Category: parts[1],
 		Service:  parts[2],
 		Params:   msg,
@@ -88,6 +241,15 @@ func createEventResponse(event *EventMessage, msg []byte) *EventResponse {
 	return &EventResponse{
 		ID:      event.ID,
 		Message: msg,
+		Base64:  event.Base64,
+	}
+}
+
+func createErrorResponse(event *EventMessage, err *RemoteError) *EventResponse {
+	return &EventResponse{
+		ID:      event.ID,
+		Message: []byte{},
+		Error:   err,
 	}
 }
 
@@ -113,7 +275,7 @@ func decodeEventMessage(data []byte) (*EventMessage, error) {
 	if xid == nil {
 		return nil, ErrInvalidEvent
 	}
-	id, err := strconv.Atoi(xid.Text())
+	id, err := strconv.Atoi(elementText(xid))
 	if err != nil {
 		return nil, ErrInvalidEvent
 	}
@@ -122,33 +284,55 @@ func decodeEventMessage(data []byte) (*EventMessage, error) {
 	if xtoken == nil {
 		return nil, ErrInvalidEvent
 	}
-	token := xtoken.Text()
+	token := elementText(xtoken)
 
 	xcategory := root.SelectElement("catgory")
 	if xcategory == nil {
 		return nil, ErrInvalidEvent
 	}
-	category := xcategory.Text()
+	category := elementText(xcategory)
 
 	xservice := root.SelectElement("service")
 	if xservice == nil {
 		return nil, ErrInvalidEvent
 	}
-	service := xservice.Text()
+	service := elementText(xservice)
 
 	xparams := root.SelectElement("params")
 	if xparams == nil {
 		return nil, ErrInvalidEvent
 	}
-	params := xparams.Text()
+	params, isBase64, err := elementData(xparams)
+	if err != nil {
+		return nil, ErrInvalidEvent
+	}
 
 	ret := &EventMessage{
 		ID:       id,
 		Token:    token,
 		Category: category,
 		Service:  service,
-		Params:   []byte(params),
+		Params:   params,
+		Base64:   isBase64,
+	}
+	// Timestamp and nonce are optional, only AuthHMAC message have them
+	if xtimestamp := root.SelectElement("timestamp"); xtimestamp != nil {
+		timestamp, err := strconv.ParseInt(elementText(xtimestamp), 10, 64)
+		if err != nil {
+			return nil, ErrInvalidEvent
+		}
+		ret.Timestamp = timestamp
+	}
+	if xnonce := root.SelectElement("nonce"); xnonce != nil {
+		ret.Nonce = elementText(xnonce)
 	}
+	if xkeyid := root.SelectElement("keyid"); xkeyid != nil {
+		ret.KeyID = elementText(xkeyid)
+	}
+	if xcaller := root.SelectElement("caller"); xcaller != nil {
+		ret.Caller = elementText(xcaller)
+	}
+	ret.Headers = readHeaders(root)
 	return ret, nil
 }
 
@@ -166,7 +350,7 @@ func decodeEventResponse(data []byte) (*EventResponse, error) {
 	if xid == nil {
 		return nil, ErrInvalidResponse
 	}
-	id, err := strconv.Atoi(xid.Text())
+	id, err := strconv.Atoi(elementText(xid))
 	if err != nil {
 		return nil, ErrInvalidResponse
 	}
@@ -175,11 +359,21 @@ func decodeEventResponse(data []byte) (*EventResponse, error) {
 	if xmessage == nil {
 		return nil, ErrInvalidResponse
 	}
-	message := xmessage.Text()
+	message, isBase64, err := elementData(xmessage)
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
 
 	ret := &EventResponse{
 		ID:      id,
-		Message: []byte(message),
+		Message: message,
+		Base64:  isBase64,
+	}
+	// Error is optional, only failed response have it
+	if xerror := root.SelectElement("error"); xerror != nil {
+		code := xerror.SelectAttrValue("code", ErrCodeServiceError)
+		ret.Error = NewRemoteError(code, elementText(xerror))
 	}
+	ret.Headers = readHeaders(root)
 	return ret, nil
 }
@@ -0,0 +1,175 @@
+package servicebus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodePyServicebusEvent(t *testing.T) {
+	data := []byte(`<?xml version="1.0"?>
+<event version="1">
+  <id>12</id>
+  <token>abc</token>
+  <catgory>math</catgory>
+  <service>add</service>
+  <params><![CDATA[[1, 2]]]></params>
+</event>
+`)
+	event, err := decodeEventMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != 12 || event.Token != "abc" || event.Category != "math" || event.Service != "add" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if string(event.Params) != "[1, 2]" || event.Base64 {
+		t.Fatalf("unexpected params %q", event.Params)
+	}
+}
+
+func TestEventXMLKeepsTextInCDATA(t *testing.T) {
+	tests := []string{
+		"x\r\ny",
+		"a]]>b",
+		"<tag attr=\"&\">",
+		"中文",
+	}
+	for _, params := range tests {
+		event := &EventMessage{ID: 1, Params: []byte(params)}
+		data := event.toXML()
+		if bytes.Contains(data, []byte("base64")) {
+			t.Fatalf("params %q is base64 encoded: %s", params, data)
+		}
+		decoded, err := decodeEventMessage(data)
+		if err != nil {
+			t.Fatalf("params %q: %v", params, err)
+		}
+		if string(decoded.Params) != params {
+			t.Fatalf("params %q decoded as %q", params, decoded.Params)
+		}
+	}
+}
+
+func TestEventXMLBase64(t *testing.T) {
+	event := &EventMessage{ID: 1, Params: []byte{0, 1, 0xff}}
+	data := event.toXML()
+	if !bytes.Contains(data, []byte(`<params encoding="base64">`)) {
+		t.Fatalf("binary params are not base64 encoded: %s", data)
+	}
+	event = &EventMessage{ID: 1, Params: []byte("text"), Base64: true}
+	decoded, err := decodeEventMessage(event.toXML())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Params) != "text" || !decoded.Base64 {
+		t.Fatalf("unexpected event %+v", decoded)
+	}
+}
+
+func TestEventXMLEscapesFields(t *testing.T) {
+	event := &EventMessage{ID: 1, Token: "a&b", Category: "<c>", Service: "s\"]]>", Params: []byte{}}
+	data := event.toXML()
+	if bytes.Contains(data, []byte("<c>")) {
+		t.Fatalf("category is not escaped: %s", data)
+	}
+	decoded, err := decodeEventMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Token != event.Token || decoded.Category != event.Category || decoded.Service != event.Service {
+		t.Fatalf("unexpected event %+v", decoded)
+	}
+}
+
+// xmlField return value after XML escaping, invalid XML characters are
+// replaced so they can not round trip
+func xmlField(value string) string {
+	var buf bytes.Buffer
+	writeElement(&buf, "f", value)
+	return buf.String()
+}
+
+func FuzzEventRoundTrip(f *testing.F) {
+	f.Add("token", "math", "add", "Node1", "nonce", "key", []byte("[1, 2]"), false, int64(100))
+	f.Add("a&b", "<c>", "s]]>", "", "", "", []byte("x\r\ny]]>z\r"), false, int64(0))
+	f.Add("", "", "", "", "", "", []byte{0, 0xff, '\r'}, true, int64(-1))
+	f.Fuzz(func(t *testing.T, token, category, service, caller, nonce, keyID string, params []byte, useBase64 bool, timestamp int64) {
+		event := &EventMessage{
+			ID:        7,
+			Token:     token,
+			Category:  category,
+			Service:   service,
+			Params:    params,
+			Caller:    caller,
+			Timestamp: timestamp,
+			Nonce:     nonce,
+			KeyID:     keyID,
+			Base64:    useBase64,
+		}
+		data := event.toXML()
+		decoded, err := decodeEventMessage(data)
+		if err != nil {
+			t.Fatalf("decode %q: %v", data, err)
+		}
+		if decoded.ID != event.ID || !bytes.Equal(decoded.Params, params) {
+			t.Fatalf("event %+v decoded as %+v", event, decoded)
+		}
+		if useBase64 != decoded.Base64 && (useBase64 || isXMLText(params)) {
+			t.Fatalf("base64 %v decoded as %v", useBase64, decoded.Base64)
+		}
+		fields := [][2]string{
+			{token, decoded.Token},
+			{category, decoded.Category},
+			{service, decoded.Service},
+			{caller, decoded.Caller},
+			{keyID, decoded.KeyID},
+		}
+		if nonce != "" {
+			fields = append(fields, [2]string{nonce, decoded.Nonce})
+			if decoded.Timestamp != timestamp {
+				t.Fatalf("timestamp %d decoded as %d", timestamp, decoded.Timestamp)
+			}
+		}
+		for _, field := range fields {
+			if xmlField(field[0]) != xmlField(field[1]) {
+				t.Fatalf("field %q decoded as %q", field[0], field[1])
+			}
+		}
+	})
+}
+
+func FuzzResponseRoundTrip(f *testing.F) {
+	f.Add([]byte("3"), false, "", "")
+	f.Add([]byte("x\r\n]]>"), false, ErrCodeServiceError, "100% failed\r\n<&>")
+	f.Add([]byte{0xff}, true, "C\"ODE", "")
+	f.Fuzz(func(t *testing.T, message []byte, useBase64 bool, code, errMessage string) {
+		resp := &EventResponse{ID: 9, Message: message, Base64: useBase64}
+		if code != "" {
+			resp.Error = NewRemoteError(code, errMessage)
+		}
+		data := resp.toXML()
+		decoded, err := decodeEventResponse(data)
+		if err != nil {
+			t.Fatalf("decode %q: %v", data, err)
+		}
+		if decoded.ID != resp.ID || !bytes.Equal(decoded.Message, message) {
+			t.Fatalf("response %+v decoded as %+v", resp, decoded)
+		}
+		if code == "" {
+			if decoded.Error != nil {
+				t.Fatalf("unexpected error %v", decoded.Error)
+			}
+			return
+		}
+		if decoded.Error == nil {
+			t.Fatalf("error %v is lost in %q", resp.Error, data)
+		}
+		if xmlField(decoded.Error.Code) != xmlField(code) && strings.TrimSpace(code) != "" {
+			t.Fatalf("code %q decoded as %q", code, decoded.Error.Code)
+		}
+		if xmlField(decoded.Error.Message) != xmlField(errMessage) {
+			t.Fatalf("error message %q decoded as %q", errMessage, decoded.Error.Message)
+		}
+	})
+}
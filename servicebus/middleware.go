@@ -0,0 +1,46 @@
+package servicebus
+
+import (
+	"context"
+)
+
+// Invocation is a service call passed through middleware chain
+type Invocation struct {
+	// Context is passed to service as Request.Context(), middleware can
+	// replace it to carry values such as tracing spans
+	Context context.Context
+	// Type is MessageType or RPCType
+	Type int
+	// Service is called service in "module.service" format
+	Service string
+	// Event is decoded request message
+	Event *EventMessage
+	// KeyID is ID of key which signed the message
+	KeyID   string
+	Request Request
+	// Response is nil for MessageType
+	Response Response
+}
+
+// Handler process an Invocation. Returned error is handled as error returned
+// by Service: it is replied to RPC caller if no response was sent, and it
+// decides message acknowledgement, see AckMode.
+type Handler func(inv *Invocation) error
+
+// Middleware wrap a Handler. Middleware can short-circuit by sending response
+// or returning error without calling next.
+type Middleware func(next Handler) Handler
+
+// Use add middleware to Server, it must be called before Start. First added
+// middleware is the outermost one.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middlewares = append(s.middlewares, middleware...)
+}
+
+// chainMiddlewares wrap handler by middlewares
+func chainMiddlewares(middlewares []Middleware, handler Handler) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,90 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	broker := newFakeBroker(t)
+	server := NewServer(broker.Config())
+	var lock sync.Mutex
+	var order []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(inv *Invocation) error {
+				lock.Lock()
+				order = append(order, name+" in")
+				lock.Unlock()
+				err := next(inv)
+				lock.Lock()
+				order = append(order, name+" out")
+				lock.Unlock()
+				return err
+			}
+		}
+	}
+	shortCircuit := func(next Handler) Handler {
+		return func(inv *Invocation) error {
+			switch inv.Service {
+			case "test.short":
+				return inv.Response.SendString("short")
+			case "test.error":
+				return errors.New("rejected by middleware")
+			}
+			return next(inv)
+		}
+	}
+	server.Use(record("first"), record("second"), shortCircuit)
+	service := &countService{}
+	server.RegisterService("test", "count", service)
+	server.RegisterService("test", "short", service)
+	server.RegisterService("test", "error", service)
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// First added middleware is the outermost one
+	ret, err := sender.CallContext(ctx, "Node1.test.count", []byte("request"))
+	if err != nil || string(ret) != "ok" {
+		t.Fatalf("got %q, %v", ret, err)
+	}
+	lock.Lock()
+	got := order
+	lock.Unlock()
+	want := []string{"first in", "second in", "second out", "first out"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("middlewares run in order %v, want %v", got, want)
+	}
+
+	// Middleware reply without calling service
+	ret, err = sender.CallContext(ctx, "Node1.test.short", []byte("request"))
+	if err != nil || string(ret) != "short" {
+		t.Fatalf("got %q, %v", ret, err)
+	}
+
+	// Error returned by middleware is replied to caller
+	_, err = sender.CallContext(ctx, "Node1.test.error", []byte("request"))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != ErrCodeServiceError || rerr.Message != "rejected by middleware" {
+		t.Fatalf("got error %v, want RemoteError from middleware", err)
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Fatalf("service is called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,76 @@
+package servicebus
+
+import (
+	"errors"
+)
+
+var (
+	ErrForbidden = errors.New("Forbidden")
+)
+
+// Policy decide which callers can invoke services. Deny rules are checked
+// first. If an allow list is not empty, caller must match it.
+//
+// Key IDs are the only authenticated identity of callers, use AllowKeyIDs
+// and DenyKeyIDs for access control.
+type Policy struct {
+	// AllowCallers and DenyCallers match Caller, which is NodeName claimed
+	// by sender. They are advisory only, such as for routing mistakes: any
+	// sender can claim any NodeName, and with AuthHMAC any holder of a key
+	// can sign any NodeName. They are not access control.
+	AllowCallers []string
+	DenyCallers  []string
+	// AllowKeyIDs and DenyKeyIDs match ID of key which signed the message
+	AllowKeyIDs []string
+	DenyKeyIDs  []string
+}
+
+// Allows report whether caller signed by key keyID can invoke service
+func (p *Policy) Allows(caller, keyID string) bool {
+	if p == nil {
+		return true
+	}
+	if contains(p.DenyCallers, caller) || contains(p.DenyKeyIDs, keyID) {
+		return false
+	}
+	if len(p.AllowCallers) > 0 && !contains(p.AllowCallers, caller) {
+		return false
+	}
+	if len(p.AllowKeyIDs) > 0 && !contains(p.AllowKeyIDs, keyID) {
+		return false
+	}
+	return true
+}
+
+func contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPolicy set authorization policy of service
+func WithPolicy(policy *Policy) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.policy = policy
+	}
+}
+
+// SetCategoryPolicy set authorization policy for all services in category,
+// it is checked before service's own policy. It must be called before Start.
+func (s *Server) SetCategoryPolicy(category string, policy *Policy) {
+	s.policies[category] = policy
+}
+
+// authorize check category policy and service policy of event
+func (s *Server) authorize(event *EventMessage, keyID string, worker *worker) error {
+	if !s.policies[event.Category].Allows(event.Caller, keyID) {
+		return ErrForbidden
+	}
+	if !worker.options.policy.Allows(event.Caller, keyID) {
+		return ErrForbidden
+	}
+	return nil
+}
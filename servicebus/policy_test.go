@@ -0,0 +1,94 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countService count messages and reply "ok" to calls
+type countService struct {
+	calls    int32
+	messages int32
+}
+
+func (s *countService) IsBackground() bool {
+	return false
+}
+
+func (s *countService) OnMessage(req Request) error {
+	atomic.AddInt32(&s.messages, 1)
+	return nil
+}
+
+func (s *countService) OnCall(req Request, resp Response) error {
+	atomic.AddInt32(&s.calls, 1)
+	return resp.SendString("ok")
+}
+
+func TestPolicyDenyKeyID(t *testing.T) {
+	broker := newFakeBroker(t)
+	config := broker.Config()
+	config.AuthMode = AuthHMAC
+	config.AckMode = AckAfterSuccess
+	config.SecretKeys = map[string]string{"k2": "secret2"}
+	server := NewServer(config)
+	service := &countService{}
+	server.RegisterService("test", "guarded", service, WithPolicy(&Policy{DenyKeyIDs: []string{"k2"}}))
+	server.RegisterService("private", "sink", service)
+	server.SetCategoryPolicy("private", &Policy{DenyKeyIDs: []string{"k2"}})
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	allowed := NewSender(config)
+	defer allowed.Close()
+	deniedConfig := *config
+	deniedConfig.SigningKeyID = "k2"
+	denied := NewSender(&deniedConfig)
+	defer denied.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := allowed.CallContext(ctx, "Node1.test.guarded", []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := denied.CallContext(ctx, "Node1.test.guarded", []byte("request"))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != ErrCodeForbidden {
+		t.Fatalf("got error %v, want RemoteError %s", err, ErrCodeForbidden)
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Fatalf("service is called %d times, want 1", calls)
+	}
+	waitFor(t, 5*time.Second, "call nacked", func() bool {
+		return broker.Dropped() == 1
+	})
+
+	// Denied message is nacked and dropped
+	if err := denied.Send("Node1.private.sink", []byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "message nacked", func() bool {
+		return broker.Dropped() == 2
+	})
+	if err := allowed.Send("Node1.private.sink", []byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "message processed", func() bool {
+		return atomic.LoadInt32(&service.messages) == 1
+	})
+	if ready := broker.Ready("Node1"); ready != 0 {
+		t.Fatalf("%d messages left in queue", ready)
+	}
+	if dropped := broker.Dropped(); dropped != 2 {
+		t.Fatalf("%d messages dropped, want 2", dropped)
+	}
+}
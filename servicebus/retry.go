@@ -0,0 +1,104 @@
+package servicebus
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	defaultMultiplier     = 2.0
+)
+
+// RetryPolicy decide how failed Sender operations are retried. A call
+// published to broker is only retried if it is marked by Idempotent option,
+// calls failed before publishing are always safe to retry.
+type RetryPolicy struct {
+	// MaxAttempts is max attempts including the first one, 0 or 1 means
+	// no retry
+	MaxAttempts int
+	// InitialBackoff is wait time before first retry, default is 100ms
+	InitialBackoff time.Duration
+	// MaxBackoff is max wait time between retries, default is 5 seconds
+	MaxBackoff time.Duration
+	// Multiplier is backoff growth factor, default is 2
+	Multiplier float64
+	// Jitter randomize backoff by this fraction, such as 0.2 for ±20%
+	Jitter float64
+	// AttemptTimeout is timeout of each attempt, 0 means attempts share
+	// the deadline of caller's context
+	AttemptTimeout time.Duration
+	// Retryable decide which errors can be retried, nil means
+	// DefaultRetryable
+	Retryable func(err error) bool
+	// SwitchHost make retry use a different healthy host if there is one
+	SwitchHost bool
+}
+
+// DefaultRetryable retry timeouts, connection errors and busy services
+func DefaultRetryable(err error) bool {
+	switch err {
+	case ErrTimeout, ErrConnectionClosed, ErrCannotConnectToServer, ErrPingFailed:
+		return true
+	}
+	var aerr *amqp.Error
+	if errors.As(err, &aerr) {
+		return true
+	}
+	var rerr *RemoteError
+	if errors.As(err, &rerr) {
+		return rerr.Code == ErrCodeBusy
+	}
+	return false
+}
+
+// shouldRetry report whether call failed by err at attempt should be retried
+func (p *RetryPolicy) shouldRetry(attempt int, call *ClientCall, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if call.published && !call.Idempotent && call.Kind != KindPing {
+		return false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+	return retryable(err)
+}
+
+// backoff return wait time before retry after attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultMultiplier
+	}
+	d := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) attemptTimeout() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.AttemptTimeout
+}
@@ -0,0 +1,122 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3}
+	tests := []struct {
+		attempt    int
+		kind       CallKind
+		published  bool
+		idempotent bool
+		err        error
+		retry      bool
+	}{
+		{1, KindCall, false, false, ErrCannotConnectToServer, true},
+		{2, KindCall, false, false, ErrConnectionClosed, true},
+		{3, KindCall, false, false, ErrConnectionClosed, false},
+		{1, KindCall, true, false, ErrTimeout, false},
+		{1, KindCall, true, true, ErrTimeout, true},
+		{1, KindPing, true, false, ErrPingFailed, true},
+		{1, KindSend, true, false, ErrConnectionClosed, false},
+		{1, KindCall, true, true, NewRemoteError(ErrCodeBusy, "busy"), true},
+		{1, KindCall, true, true, NewRemoteError(ErrCodeServiceError, "failed"), false},
+		{1, KindCall, false, false, context.Canceled, false},
+		{1, KindCall, false, false, errors.New("other"), false},
+	}
+	for i, test := range tests {
+		call := &ClientCall{Kind: test.kind, Idempotent: test.idempotent, published: test.published}
+		if ret := policy.shouldRetry(test.attempt, call, test.err); ret != test.retry {
+			t.Errorf("test %d: shouldRetry(%d, %v) = %v", i, test.attempt, test.err, ret)
+		}
+	}
+	var nilPolicy *RetryPolicy
+	if nilPolicy.shouldRetry(1, &ClientCall{}, ErrTimeout) {
+		t.Error("nil policy retries")
+	}
+	custom := &RetryPolicy{MaxAttempts: 2, Retryable: func(err error) bool { return err == ErrInvalidPayload }}
+	if !custom.shouldRetry(1, &ClientCall{}, ErrInvalidPayload) || custom.shouldRetry(1, &ClientCall{}, ErrTimeout) {
+		t.Error("Retryable is not used")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	want := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second}
+	for i, d := range want {
+		if ret := policy.backoff(i + 1); ret != d {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, ret, d)
+		}
+	}
+	defaults := &RetryPolicy{}
+	if ret := defaults.backoff(1); ret != defaultInitialBackoff {
+		t.Errorf("default backoff(1) = %v", ret)
+	}
+	if ret := defaults.backoff(100); ret != defaultMaxBackoff {
+		t.Errorf("default backoff(100) = %v", ret)
+	}
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if ret := policy.backoff(1); ret < 80*time.Millisecond || ret > 120*time.Millisecond {
+			t.Fatalf("backoff with jitter is %v", ret)
+		}
+	}
+}
+
+func TestRetryConnectFailure(t *testing.T) {
+	broker := newFakeBroker(t)
+	config := broker.Config()
+	// Nothing is listening on a closed broker
+	broker.Close()
+	var failures int32
+	config.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Retryable: func(err error) bool {
+			atomic.AddInt32(&failures, 1)
+			return DefaultRetryable(err)
+		},
+	}
+	sender := NewSender(config)
+	defer sender.Close()
+	if err := sender.Send("Node1.test.echo", []byte("message")); err != ErrCannotConnectToServer {
+		t.Fatalf("got error %v, want %v", err, ErrCannotConnectToServer)
+	}
+	// The last failure is not asked
+	if n := atomic.LoadInt32(&failures); n != 2 {
+		t.Fatalf("retried %d times, want 2", n)
+	}
+}
+
+func TestRetryPublishedCall(t *testing.T) {
+	broker := newFakeBroker(t)
+	// Queue without consumer, calls to it always time out
+	broker.DeclareQueue("Node1")
+	config := broker.Config()
+	config.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		AttemptTimeout: 50 * time.Millisecond,
+	}
+	sender := NewSender(config)
+	defer sender.Close()
+	ctx := context.Background()
+	if _, err := sender.CallContext(ctx, "Node1.test.echo", []byte("request")); err != ErrTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrTimeout)
+	}
+	waitFor(t, 5*time.Second, "request published once", func() bool {
+		return broker.Ready("Node1") == 1
+	})
+	if _, err := sender.CallContext(ctx, "Node1.test.echo", []byte("request"), Idempotent()); err != ErrTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrTimeout)
+	}
+	waitFor(t, 5*time.Second, "idempotent request published 3 times", func() bool {
+		return broker.Ready("Node1") == 4
+	})
+}
@@ -0,0 +1,74 @@
+package servicebus
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// HostInfo describe a healthy broker host for HostSelector
+type HostInfo struct {
+	// Host is broker host name
+	Host string
+	// Outstanding is count of requests in progress on this host
+	Outstanding int64
+}
+
+// HostSelector choose a host for sending message to target.
+// hosts only contains healthy hosts and is never empty.
+// Select returns index of chosen host.
+type HostSelector interface {
+	Select(target string, hosts []HostInfo) int
+}
+
+// FirstHealthySelector always choose first healthy host in Config.Hosts order
+func FirstHealthySelector() HostSelector {
+	return firstHealthySelector{}
+}
+
+type firstHealthySelector struct{}
+
+func (firstHealthySelector) Select(target string, hosts []HostInfo) int {
+	return 0
+}
+
+// RoundRobinSelector choose healthy hosts in turn
+func RoundRobinSelector() HostSelector {
+	return &roundRobinSelector{}
+}
+
+type roundRobinSelector struct {
+	next uint64
+}
+
+func (s *roundRobinSelector) Select(target string, hosts []HostInfo) int {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return int(n % uint64(len(hosts)))
+}
+
+// RandomSelector choose a random healthy host
+func RandomSelector() HostSelector {
+	return randomSelector{}
+}
+
+type randomSelector struct{}
+
+func (randomSelector) Select(target string, hosts []HostInfo) int {
+	return rand.Intn(len(hosts))
+}
+
+// LeastOutstandingSelector choose healthy host with fewest requests in progress
+func LeastOutstandingSelector() HostSelector {
+	return leastOutstandingSelector{}
+}
+
+type leastOutstandingSelector struct{}
+
+func (leastOutstandingSelector) Select(target string, hosts []HostInfo) int {
+	ret := 0
+	for i, host := range hosts {
+		if host.Outstanding < hosts[ret].Outstanding {
+			ret = i
+		}
+	}
+	return ret
+}
@@ -0,0 +1,94 @@
+package servicebus
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectors(t *testing.T) {
+	hosts := []HostInfo{
+		{Host: "a", Outstanding: 3},
+		{Host: "b", Outstanding: 1},
+		{Host: "c", Outstanding: 1},
+	}
+	if idx := FirstHealthySelector().Select("Node1.a.b", hosts); idx != 0 {
+		t.Fatalf("FirstHealthySelector choose %d", idx)
+	}
+	if idx := LeastOutstandingSelector().Select("Node1.a.b", hosts); idx != 1 {
+		t.Fatalf("LeastOutstandingSelector choose %d", idx)
+	}
+	selector := RoundRobinSelector()
+	for i := 0; i < 6; i++ {
+		if idx := selector.Select("Node1.a.b", hosts); idx != i%3 {
+			t.Fatalf("RoundRobinSelector choose %d at %d", idx, i)
+		}
+	}
+	selector = RandomSelector()
+	for i := 0; i < 100; i++ {
+		if idx := selector.Select("Node1.a.b", hosts); idx < 0 || idx >= len(hosts) {
+			t.Fatalf("RandomSelector choose %d", idx)
+		}
+	}
+}
+
+func TestRoundRobinSelectorConcurrent(t *testing.T) {
+	hosts := []HostInfo{{Host: "a"}, {Host: "b"}}
+	selector := RoundRobinSelector()
+	var lock sync.Mutex
+	counts := make([]int, len(hosts))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				idx := selector.Select("Node1.a.b", hosts)
+				lock.Lock()
+				counts[idx]++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if counts[0] != 400 || counts[1] != 400 {
+		t.Fatalf("unbalanced selection %v", counts)
+	}
+}
+
+func TestExcludeSenders(t *testing.T) {
+	a, b, c := &amqpSender{}, &amqpSender{}, &amqpSender{}
+	senders := []*amqpSender{a, b, c}
+	ret := excludeSenders(senders, []*amqpSender{a, c})
+	if len(ret) != 1 || ret[0] != b {
+		t.Fatalf("unexpected senders %v", ret)
+	}
+	// All senders are excluded, keep trying them
+	ret = excludeSenders(senders, senders)
+	if len(ret) != 3 {
+		t.Fatalf("unexpected senders %v", ret)
+	}
+}
+
+func TestSelectorSpreadSendsAcrossHosts(t *testing.T) {
+	brokers := []*fakeBroker{newFakeBroker(t), newFakeBroker(t)}
+	config := brokers[0].Config()
+	config.Hosts = []string{brokers[0].Addr(), brokers[1].Addr()}
+	config.HostSelector = RoundRobinSelector()
+	for _, broker := range brokers {
+		broker.DeclareQueue("Node1")
+	}
+	sender := NewSender(config)
+	defer sender.Close()
+	for i := 0; i < 4; i++ {
+		if err := sender.Send("Node1.test.echo", []byte("message")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, broker := range brokers {
+		// Without PingBeforeSend, only the messages are published
+		waitFor(t, 5*time.Second, "2 messages on each host", func() bool {
+			return broker.Ready("Node1") == 2
+		})
+	}
+}
@@ -2,24 +2,107 @@ package servicebus
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
 )
 
 var (
 	ErrCannotConnectToServer = errors.New("Cannot connect to server")
 )
 
+const (
+	reconnectMinBackoff = 1 * time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
 // amqpSender is Sender interface implements for one RabbitMQ connection
 type amqpSender struct {
-	driver *AMQPDriver
+	driver      *AMQPDriver
+	healthy     int32
+	outstanding int64
+	stop        chan struct{}
+}
+
+func newAMQPSender(driver *AMQPDriver) *amqpSender {
+	return &amqpSender{
+		driver: driver,
+		stop:   make(chan struct{}),
+	}
+}
+
+// IsHealthy report whether sender's connection is alive
+func (s *amqpSender) IsHealthy() bool {
+	return atomic.LoadInt32(&s.healthy) == 1
+}
+
+func (s *amqpSender) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&s.healthy, 1)
+	} else {
+		atomic.StoreInt32(&s.healthy, 0)
+	}
+}
+
+// keepAlive watch sender's connection and reconnect with backoff when
+// connection is closed, until sender is closed
+func (s *amqpSender) keepAlive() {
+	backoff := reconnectMinBackoff
+	for {
+		if !s.IsHealthy() {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			if err := s.driver.Dial(); err != nil {
+				log.Printf("[%s] Reconnect Error: %v", s.driver.host, err)
+				backoff *= 2
+				if backoff > reconnectMaxBackoff {
+					backoff = reconnectMaxBackoff
+				}
+				continue
+			}
+			select {
+			case <-s.stop:
+				// Sender closed while dialing
+				s.driver.Close()
+				return
+			default:
+			}
+			log.Printf("[%s] Reconnected", s.driver.host)
+			backoff = reconnectMinBackoff
+			s.setHealthy(true)
+		}
+		closed := s.driver.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case <-s.stop:
+			return
+		case err := <-closed:
+			log.Printf("[%s] Connection Closed: %v", s.driver.host, err)
+			s.setHealthy(false)
+			s.driver.Close()
+		}
+	}
 }
 
 func (s *amqpSender) Ping(target string, timeout int) bool {
-	queue, _, err := createEventMessage(target, "", []byte{})
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	return s.PingContext(ctx, target)
+}
+
+func (s *amqpSender) PingContext(ctx context.Context, target string) bool {
+	queue, _, err := createEventMessage(target, []byte{})
 	if err != nil {
 		return false
 	}
-	ret, err := s.driver.Call(queue, []byte("PING"), timeout)
+	ret, err := s.driver.CallContext(ctx, queue, []byte("PING"))
 	if err != nil {
 		return false
 	}
@@ -27,111 +110,369 @@ func (s *amqpSender) Ping(target string, timeout int) bool {
 }
 
 func (s *amqpSender) Send(target string, message []byte) error {
-	token := s.driver.config.generateToken("now")
-	queue, msg, err := createEventMessage(target, token, message)
+	return s.SendContext(context.Background(), target, message)
+}
+
+func (s *amqpSender) SendContext(ctx context.Context, target string, message []byte, opts ...CallOption) error {
+	return s.send(ctx, newClientCall(KindSend, target, message, opts))
+}
+
+// encodeEvent create and sign event of call, return target queue, Codec and
+// encoded event
+func (s *amqpSender) encodeEvent(call *ClientCall) (string, Codec, []byte, error) {
+	queue, msg, err := createEventMessage(call.Target, call.Params)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	msg.Headers = call.Headers
+	msg.Base64 = s.driver.config.Base64Params
+	s.driver.config.signEvent(msg)
+	codec := s.driver.config.codec()
+	body, err := codec.EncodeEvent(msg)
 	if err != nil {
+		return "", nil, nil, err
+	}
+	return queue, codec, body, nil
+}
+
+// send publish call's message, call is marked published if succeeded
+func (s *amqpSender) send(ctx context.Context, call *ClientCall) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.outstanding, 1)
+	defer atomic.AddInt64(&s.outstanding, -1)
+	queue, codec, body, err := s.encodeEvent(call)
+	if err != nil {
+		return err
+	}
+	if err := s.driver.send(queue, codec.ContentType(), call.MessageID, body); err != nil {
 		return err
 	}
-	return s.driver.Send(queue, msg.toXML())
+	call.published = true
+	return nil
 }
 
 func (s *amqpSender) Call(target string, message []byte, timeout int) ([]byte, error) {
-	token := s.driver.config.generateToken("now")
-	queue, msg, err := createEventMessage(target, token, message)
-	if err != nil {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	ret, err := s.CallContext(ctx, target, message)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeout
+	}
+	return ret, err
+}
+
+func (s *amqpSender) CallContext(ctx context.Context, target string, message []byte, opts ...CallOption) ([]byte, error) {
+	call := newClientCall(KindCall, target, message, opts)
+	if err := s.call(ctx, call); err != nil {
 		return nil, err
 	}
-	ret, err := s.driver.Call(queue, msg.toXML(), timeout)
+	return call.Result, nil
+}
+
+// call do RPC request and set call.Result, call is marked published once
+// request is published
+func (s *amqpSender) call(ctx context.Context, call *ClientCall) error {
+	atomic.AddInt64(&s.outstanding, 1)
+	defer atomic.AddInt64(&s.outstanding, -1)
+	queue, codec, body, err := s.encodeEvent(call)
+	if err != nil {
+		return err
+	}
+	ret, err := s.driver.call(ctx, queue, codec.ContentType(), call.MessageID, body, &call.published)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	resp, err := decodeEventResponse(ret)
+	resp, err := codec.DecodeResponse(ret)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return resp.Message, nil
+	call.setReplyHeaders(resp.Headers)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	call.Result = resp.Message
+	return nil
 }
 
 func (s *amqpSender) Close() error {
+	close(s.stop)
+	s.setHealthy(false)
 	return s.driver.Close()
 }
 
 // smartSender is Sender interface implements
 // It can choose a available path to send message to Server
 type smartSender struct {
-	config  *Config
-	senders []*amqpSender
+	config      *Config
+	invoker     Invoker
+	breakers    *breakerSet
+	lock        sync.Mutex
+	initialized bool
+	closed      bool
+	senders     []*amqpSender
 }
 
 // NewSender create smart sender
 func NewSender(config *Config) Sender {
-	return &smartSender{
+	s := &smartSender{
 		config: config,
 	}
+	if config.CircuitBreaker != nil {
+		s.breakers = newBreakerSet(config.CircuitBreaker)
+	}
+	s.invoker = chainInterceptors(config.Interceptors, s.invoke)
+	return s
 }
 
-func (s *smartSender) selectSender(target string, doPing bool) Sender {
-	if len(s.senders) == 0 {
+// getSenders return healthy senders, connect to servers if not connected
+func (s *smartSender) getSenders() []*amqpSender {
+	s.lock.Lock()
+	if !s.initialized && !s.closed {
 		s.initializeSenders()
 	}
-	if doPing {
-		for _, sender := range s.senders {
-			if sender.Ping(target, 3) {
-				return sender
-			}
+	senders := s.senders
+	s.lock.Unlock()
+	healthy := make([]*amqpSender, 0, len(senders))
+	for _, sender := range senders {
+		if sender.IsHealthy() {
+			healthy = append(healthy, sender)
 		}
+	}
+	return healthy
+}
+
+// selectSender choose a healthy sender by config.HostSelector. If doPing is
+// true, hosts are pinged start from the chosen one and first host answering
+// ping is returned. Senders in exclude are skipped unless all healthy
+// senders are excluded.
+func (s *smartSender) selectSender(ctx context.Context, target string, doPing bool, exclude []*amqpSender) *amqpSender {
+	senders := excludeSenders(s.getSenders(), exclude)
+	if len(senders) == 0 {
 		return nil
-	} else {
-		if len(s.senders) > 0 {
-			return s.senders[0]
+	}
+	selector := s.config.HostSelector
+	if selector == nil {
+		selector = FirstHealthySelector()
+	}
+	hosts := make([]HostInfo, len(senders))
+	for i, sender := range senders {
+		hosts[i] = HostInfo{
+			Host:        sender.driver.host,
+			Outstanding: atomic.LoadInt64(&sender.outstanding),
+		}
+	}
+	idx := selector.Select(target, hosts)
+	if idx < 0 || idx >= len(senders) {
+		idx = 0
+	}
+	if !doPing {
+		return senders[idx]
+	}
+	for i := range senders {
+		sender := senders[(idx+i)%len(senders)]
+		pctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		ok := sender.PingContext(pctx, target)
+		cancel()
+		if ok {
+			return sender
 		}
-		return nil
 	}
+	return nil
 }
 
 func (s *smartSender) Ping(target string, timeout int) bool {
-	sender := s.selectSender(target, false)
-	if sender == nil {
-		return false
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	return s.PingContext(ctx, target)
+}
+
+func (s *smartSender) PingContext(ctx context.Context, target string) bool {
+	call := &ClientCall{
+		Kind:   KindPing,
+		Target: target,
 	}
-	return sender.Ping(target, timeout)
+	return s.invoker(ctx, call) == nil
 }
 
 func (s *smartSender) Send(target string, message []byte) error {
-	sender := s.selectSender(target, true)
-	if sender == nil {
-		return ErrCannotConnectToServer
-	}
-	return sender.Send(target, message)
+	return s.SendContext(context.Background(), target, message)
+}
+
+func (s *smartSender) SendContext(ctx context.Context, target string, message []byte, opts ...CallOption) error {
+	return s.invoker(ctx, newClientCall(KindSend, target, message, opts))
 }
 
 func (s *smartSender) Call(target string, message []byte, timeout int) ([]byte, error) {
-	sender := s.selectSender(target, true)
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	ret, err := s.CallContext(ctx, target, message)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeout
+	}
+	return ret, err
+}
+
+func (s *smartSender) CallContext(ctx context.Context, target string, message []byte, opts ...CallOption) ([]byte, error) {
+	call := newClientCall(KindCall, target, message, opts)
+	if err := s.invoker(ctx, call); err != nil {
+		return nil, err
+	}
+	return call.Result, nil
+}
+
+// invoke is the innermost Invoker, it executes call and retries it by
+// config.RetryPolicy
+func (s *smartSender) invoke(ctx context.Context, call *ClientCall) error {
+	policy := s.config.RetryPolicy
+	tried := []*amqpSender{}
+	for attempt := 1; ; attempt++ {
+		call.published = false
+		sender, err := s.invokeOnce(ctx, call, policy, tried)
+		if err == nil || !policy.shouldRetry(attempt, call, err) {
+			return err
+		}
+		if sender != nil && policy.SwitchHost {
+			tried = append(tried, sender)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+}
+
+// invokeOnce select host and execute call once, hosts in exclude are
+// skipped if there are other healthy hosts
+func (s *smartSender) invokeOnce(ctx context.Context, call *ClientCall, policy *RetryPolicy, exclude []*amqpSender) (*amqpSender, error) {
+	if timeout := policy.attemptTimeout(); timeout > 0 {
+		actx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		sender, err := s.invokeOnce(actx, call, nil, exclude)
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			// Only this attempt timed out
+			err = ErrTimeout
+		}
+		return sender, err
+	}
+	if s.breakers == nil {
+		return s.execute(ctx, call, exclude)
+	}
+	now := time.Now()
+	targetBreaker := s.breakers.Target(call.Target)
+	if !targetBreaker.Allow(now) {
+		return nil, ErrCircuitOpen
+	}
+	// Skip hosts with open breaker
+	exclude = append([]*amqpSender{}, exclude...)
+	for _, sender := range s.getSenders() {
+		if s.breakers.Host(sender.driver.host).IsOpen(now) {
+			exclude = append(exclude, sender)
+		}
+	}
+	sender, err := s.execute(ctx, call, exclude)
+	if sender != nil && err == ErrCircuitOpen {
+		// Host breaker rejected the call, target is not tried
+		targetBreaker.Release()
+		return sender, err
+	}
+	now = time.Now()
+	recordBreaker(targetBreaker, err, isTargetFailure, now)
+	if sender != nil {
+		recordBreaker(s.breakers.Host(sender.driver.host), err, isHostFailure, now)
+	}
+	return sender, err
+}
+
+// execute select host and execute call
+func (s *smartSender) execute(ctx context.Context, call *ClientCall, exclude []*amqpSender) (*amqpSender, error) {
+	doPing := s.config.PingBeforeSend && call.Kind != KindPing
+	sender := s.selectSender(ctx, call.Target, doPing, exclude)
 	if sender == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		return nil, ErrCannotConnectToServer
 	}
-	return sender.Call(target, message, timeout)
+	if s.breakers != nil && !s.breakers.Host(sender.driver.host).Allow(time.Now()) {
+		return sender, ErrCircuitOpen
+	}
+	switch call.Kind {
+	case KindPing:
+		if !sender.PingContext(ctx, call.Target) {
+			return sender, ErrPingFailed
+		}
+		return sender, nil
+	case KindSend:
+		return sender, sender.send(ctx, call)
+	default:
+		return sender, sender.call(ctx, call)
+	}
 }
 
-func (s *smartSender) initializeSenders() {
-	drivers := []*AMQPDriver{}
-	for _, host := range s.config.Hosts {
-		driver := newAMQPDriver(host, s.config)
-		err := driver.Dial()
-		if err == nil {
-			drivers = append(drivers, driver)
+// Breakers return status of all circuit breakers, it is empty if
+// Config.CircuitBreaker is nil
+func (s *smartSender) Breakers() []BreakerStatus {
+	if s.breakers == nil {
+		return []BreakerStatus{}
+	}
+	return s.breakers.Statuses()
+}
+
+func excludeSenders(senders []*amqpSender, exclude []*amqpSender) []*amqpSender {
+	if len(exclude) == 0 {
+		return senders
+	}
+	ret := make([]*amqpSender, 0, len(senders))
+	for _, sender := range senders {
+		excluded := false
+		for _, e := range exclude {
+			if sender == e {
+				excluded = true
+				break
+			}
 		}
+		if !excluded {
+			ret = append(ret, sender)
+		}
+	}
+	if len(ret) == 0 {
+		return senders
 	}
-	senders := make([]*amqpSender, len(drivers))
-	for i, driver := range drivers {
-		senders[i] = &amqpSender{driver}
+	return ret
+}
+
+// initializeSenders connect to every host. Hosts can not be connected are
+// marked unhealthy and will be retried in background.
+func (s *smartSender) initializeSenders() {
+	endpoints := s.config.endpoints()
+	senders := make([]*amqpSender, len(endpoints))
+	for i, endpoint := range endpoints {
+		sender := newAMQPSender(newAMQPDriver(endpoint, s.config))
+		if err := sender.driver.Dial(); err == nil {
+			sender.setHealthy(true)
+		} else {
+			log.Printf("[%s] Connect Error: %v", sender.driver.host, err)
+		}
+		go sender.keepAlive()
+		senders[i] = sender
 	}
 	s.senders = senders
+	s.initialized = true
 }
 
+// Close close all connections, closed sender does not connect again and its
+// operations fail with ErrCannotConnectToServer
 func (s *smartSender) Close() error {
+	s.lock.Lock()
+	senders := s.senders
+	s.senders = nil
+	s.closed = true
+	s.lock.Unlock()
 	var err error = nil
-	for _, sender := range s.senders {
+	for _, sender := range senders {
 		if err == nil {
 			err = sender.Close()
 		} else {
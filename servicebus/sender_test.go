@@ -0,0 +1,91 @@
+package servicebus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoServer start a Server on broker with service test.echo, which
+// replies request payload
+func startEchoServer(t *testing.T, broker *fakeBroker) *Server {
+	server := NewServer(broker.Config())
+	RegisterTypedService(server, "test", "echo", func(ctx context.Context, req string) (string, error) {
+		return req, nil
+	}, WithConcurrency(4))
+	server.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	return server
+}
+
+func TestConcurrentCallsShareReplyQueue(t *testing.T) {
+	broker := newFakeBroker(t)
+	startEchoServer(t, broker)
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+
+	const n = 50
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			want := fmt.Sprintf("call-%d", i)
+			got, err := CallTyped[string, string](ctx, sender, "Node1.test.echo", want)
+			if err == nil && got != want {
+				err = fmt.Errorf("%s got reply %q", want, got)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if generated := broker.Generated(); generated != 1 {
+		t.Fatalf("%d reply queues are declared, want 1", generated)
+	}
+}
+
+func TestGetSendersRaceClose(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.DeclareQueue("Node1")
+	for round := 0; round < 5; round++ {
+		s := NewSender(broker.Config()).(*smartSender)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				s.getSenders()
+				s.Send("Node1.test.echo", []byte("message"))
+			}()
+		}
+		close(start)
+		s.Close()
+		wg.Wait()
+
+		if senders := s.getSenders(); len(senders) != 0 {
+			t.Fatalf("closed sender has %d senders", len(senders))
+		}
+		if err := s.Send("Node1.test.echo", []byte("message")); err != ErrCannotConnectToServer {
+			t.Fatalf("got error %v, want %v", err, ErrCannotConnectToServer)
+		}
+		// Connections opened by getSenders racing Close are not leaked
+		waitFor(t, 5*time.Second, "connections closed", func() bool {
+			return broker.Connections() == 0
+		})
+	}
+}
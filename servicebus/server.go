@@ -2,9 +2,11 @@ package servicebus
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -13,13 +15,24 @@ import (
 var (
 	ErrServiceNotFound = errors.New("Service not found")
 	ErrInvalidToken    = errors.New("Invalid token")
+	ErrServerStopped   = errors.New("Server stopped")
+	ErrServiceBusy     = errors.New("Service busy")
+	// errServiceBusyRequeue means service is busy and message should be requeued
+	errServiceBusyRequeue = errors.New("Service busy, requeue message")
 )
 
 // Server is a server to receive messages and execute services.
 type Server struct {
-	config    *Config
-	workers   map[string]*worker
-	receivers []*receiver
+	config      *Config
+	workers     map[string]*worker
+	receivers   []*receiver
+	replays     *replayCache
+	keyLock     sync.Mutex
+	keyUsage    map[string]uint64
+	policies    map[string]*Policy
+	middlewares []Middleware
+	// sender is shared by all requests, see Request.GetSender
+	sender Sender
 }
 
 // NewServer create a Server instance
@@ -28,33 +41,94 @@ func NewServer(config *Config) *Server {
 		config:    config,
 		workers:   make(map[string]*worker),
 		receivers: []*receiver{},
+		replays:   newReplayCache(2 * config.maxClockSkew()),
+		keyUsage:  make(map[string]uint64),
+		policies:  make(map[string]*Policy),
+		sender:    NewSender(config),
 	}
 }
 
 // Start start Server
 func (s *Server) Start() {
 	for _, worker := range s.workers {
-		worker.Start()
+		worker.Start(s.middlewares)
 	}
-	for _, host := range s.config.Hosts {
-		driver := newAMQPDriver(host, s.config)
-		recv := &receiver{
-			driver: driver,
-			server: s,
-		}
+	for _, endpoint := range s.config.endpoints() {
+		driver := newAMQPDriver(endpoint, s.config)
+		recv := newReceiver(driver, s)
 		recv.Start()
 		s.receivers = append(s.receivers, recv)
 	}
 }
 
+// Shutdown stop Server gracefully. It cancels AMQP consumers, stops accepting
+// new jobs, waits for running services until ctx is done, and then closes
+// connections and the Sender returned by Request.GetSender. If ctx is done
+// before all services finished, queued jobs are dropped and left to broker
+// for redelivery, running services are not interrupted, and ctx.Err() is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	for _, recv := range s.receivers {
+		recv.Stop()
+	}
+	err := waitContext(ctx, func() {
+		for _, recv := range s.receivers {
+			recv.Wait()
+		}
+	})
+	if err == nil {
+		err = waitContext(ctx, func() {
+			for _, worker := range s.workers {
+				worker.Stop()
+			}
+		})
+	}
+	if err != nil {
+		for _, worker := range s.workers {
+			worker.Abort()
+		}
+	}
+	for _, recv := range s.receivers {
+		recv.driver.Close()
+	}
+	s.sender.Close()
+	return err
+}
+
+// waitContext run fn and wait it finish until ctx is done
+func waitContext(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // RegisterService register service bus's Service
 // config.NodeName, module, service three parameter compose a final target: `NodeName.module.service`
-func (s *Server) RegisterService(module, service string, instance Service) {
+func (s *Server) RegisterService(module, service string, instance Service, options ...ServiceOption) {
 	key := fmt.Sprintf("%s.%s", module, service)
-	worker := newWorker(key, instance)
+	worker := newWorker(key, instance, newServiceOptions(options))
+	worker.sender = sharedSender{s.sender}
 	s.workers[key] = worker
 }
 
+// sharedSender is Server's Sender given to requests. Close does nothing,
+// the Sender is closed by Server.Shutdown.
+type sharedSender struct {
+	Sender
+}
+
+func (sharedSender) Close() error {
+	return nil
+}
+
 // selectWorker select correct service instance to process message
 func (s *Server) selectWorker(event *EventMessage) (*worker, error) {
 	key := fmt.Sprintf("%s.%s", event.Category, event.Service)
@@ -70,8 +144,20 @@ func (s *Server) selectWorker(event *EventMessage) (*worker, error) {
 type receiver struct {
 	driver  *AMQPDriver
 	server  *Server
+	lock    sync.Mutex
 	running bool
 	status  string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newReceiver(driver *AMQPDriver, server *Server) *receiver {
+	return &receiver{
+		driver: driver,
+		server: server,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
 }
 
 func (r *receiver) receiveMessages() error {
@@ -79,86 +165,148 @@ func (r *receiver) receiveMessages() error {
 	if err != nil {
 		return err
 	}
-	for msg := range queue {
-		msg.Ack(false)
-		if msg.ReplyTo != "" {
-			if bytes.Equal(msg.Body, []byte("PING")) {
-				err := r.onPing(msg)
-				if err != nil {
-					return err
-				}
-			} else {
-				err := r.onCall(msg)
-				if err != nil {
-					if err == ErrServiceNotFound || err == ErrInvalidEvent || err == ErrInvalidToken {
-						log.Println(err)
-					} else {
-						return err
-					}
-				}
+	for {
+		var msg amqp.Delivery
+		select {
+		case <-r.stop:
+			return r.driver.CancelConsume()
+		case delivery, ok := <-queue:
+			if !ok {
+				return nil
 			}
-		} else {
-			err := r.onMessage(msg)
+			msg = delivery
+		}
+		if msg.ReplyTo != "" && bytes.Equal(msg.Body, []byte("PING")) {
+			msg.Ack(false)
+			err := r.onPing(msg)
 			if err != nil {
-				if err == ErrServiceNotFound || err == ErrInvalidEvent || err == ErrInvalidToken {
-					log.Println(err)
-				} else {
-					return err
-				}
+				return err
+			}
+			continue
+		}
+		if msg.ReplyTo != "" {
+			err = r.onCall(msg)
+		} else {
+			err = r.onMessage(msg)
+		}
+		if err != nil {
+			if !isDispatchError(err) {
+				return err
 			}
+			log.Println(err)
+			r.reject(msg, err)
+		} else if r.server.config.AckMode == AckOnReceive {
+			msg.Ack(false)
 		}
 	}
-	return nil
+}
+
+// isDispatchError report whether err means message can not be pushed to
+// worker, receiver should reject this message and continue
+func isDispatchError(err error) bool {
+	switch err {
+	case ErrServiceNotFound, ErrInvalidEvent, ErrUnknownCodec, ErrInvalidToken, ErrMessageExpired, ErrMessageReplayed,
+		ErrForbidden, ErrServerStopped, ErrServiceBusy, errServiceBusyRequeue:
+		return true
+	}
+	return false
+}
+
+// reject settle message that can not be pushed to worker. Message rejected
+// because server is stopping or service is busy with OverflowNack is
+// requeued, others are dropped.
+func (r *receiver) reject(msg amqp.Delivery, err error) {
+	if err == ErrServerStopped || err == errServiceBusyRequeue {
+		msg.Nack(false, true)
+	} else if r.server.config.AckMode == AckOnReceive {
+		msg.Ack(false)
+	} else {
+		msg.Nack(false, false)
+	}
 }
 
 func (r *receiver) onCall(msg amqp.Delivery) error {
-	event, err := decodeEventMessage(msg.Body)
+	event, err := decodeEvent(msg)
 	if err != nil {
 		return err
 	}
-	if !r.server.config.validateToken(event.Token) {
-		return ErrInvalidToken
+	keyID, err := r.server.authenticate(event, msg.Redelivered)
+	if err != nil {
+		return err
 	}
 	worker, err := r.server.selectWorker(event)
 	if err != nil {
 		return err
 	}
-	worker.PushJob(&job{
+	if err := r.server.authorize(event, keyID, worker); err != nil {
+		log.Printf("Forbidden: caller %q key %q to %s.%s", event.Caller, keyID, event.Category, event.Service)
+		r.replyError(msg, event, NewRemoteError(ErrCodeForbidden, "Caller is not allowed to call service"))
+		return err
+	}
+	err = worker.PushJob(&job{
 		Type:    RPCType,
 		Driver:  r.driver,
 		Message: msg,
 		Event:   event,
+		KeyID:   keyID,
 	})
-	return nil
+	if err == ErrServiceBusy {
+		r.replyError(msg, event, NewRemoteError(ErrCodeBusy, "Service is busy"))
+	}
+	return err
+}
+
+// replyError send error response for RPC request not pushed to worker
+func (r *receiver) replyError(msg amqp.Delivery, event *EventMessage, rerr *RemoteError) {
+	resp := &amqpResponse{
+		driver:   r.driver,
+		delivery: msg,
+		event:    event,
+	}
+	if err := resp.sendError(rerr); err != nil {
+		log.Println("Send Error Response Error:", err)
+	}
 }
 
 func (r *receiver) onMessage(msg amqp.Delivery) error {
-	event, err := decodeEventMessage(msg.Body)
+	event, err := decodeEvent(msg)
 	if err != nil {
 		return err
 	}
-	if !r.server.config.validateToken(event.Token) {
-		return ErrInvalidToken
+	keyID, err := r.server.authenticate(event, msg.Redelivered)
+	if err != nil {
+		return err
 	}
 	worker, err := r.server.selectWorker(event)
 	if err != nil {
 		return err
 	}
-	worker.PushJob(&job{
+	if err := r.server.authorize(event, keyID, worker); err != nil {
+		log.Printf("Forbidden: caller %q key %q to %s.%s", event.Caller, keyID, event.Category, event.Service)
+		return err
+	}
+	return worker.PushJob(&job{
 		Type:    MessageType,
 		Driver:  r.driver,
 		Message: msg,
 		Event:   event,
+		KeyID:   keyID,
 	})
-	return nil
+}
+
+// decodeEvent decode message by Codec of its ContentType
+func decodeEvent(msg amqp.Delivery) (*EventMessage, error) {
+	codec, err := codecFor(msg.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	return codec.DecodeEvent(msg.Body)
 }
 
 func (r *receiver) onPing(msg amqp.Delivery) error {
-	return r.driver.channel.Publish(
+	return r.driver.Publish(
 		"",
 		msg.ReplyTo,
-		false,
-		false,
 		amqp.Publishing{
 			ContentType:   "text/plain",
 			CorrelationId: msg.CorrelationId,
@@ -169,7 +317,8 @@ func (r *receiver) onPing(msg amqp.Delivery) error {
 
 // Run execute receiver's main process
 func (r *receiver) Run() {
-	for r.running {
+	defer close(r.done)
+	for r.isRunning() {
 		log.Printf("[%s] Connecting to Server...", r.driver.host)
 		err := r.driver.Dial()
 		if err == nil {
@@ -188,14 +337,30 @@ func (r *receiver) Run() {
 		} else {
 			log.Println(err)
 		}
+		if !r.isRunning() {
+			break
+		}
 		log.Printf("[%s] Connection Error, Wait 5 Seconds to Retry", r.driver.host)
-		time.Sleep(5 * time.Second)
+		select {
+		case <-r.stop:
+		case <-time.After(5 * time.Second):
+		}
 	}
+	r.lock.Lock()
 	r.status = "Stopped"
+	r.lock.Unlock()
+}
+
+func (r *receiver) isRunning() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.running
 }
 
 // Start start receiver
 func (r *receiver) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if !r.running && r.status != "Running" {
 		r.running = true
 		r.status = "Running"
@@ -203,12 +368,29 @@ func (r *receiver) Start() {
 	}
 }
 
-// Stop stop receiver
+// Stop stop receiver, it will stop consuming messages
 func (r *receiver) Stop() {
-	r.running = false
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.running {
+		r.running = false
+		close(r.stop)
+	}
+}
+
+// Wait wait receiver stopped
+func (r *receiver) Wait() {
+	r.lock.Lock()
+	started := r.status != ""
+	r.lock.Unlock()
+	if started {
+		<-r.done
+	}
 }
 
 // Status report receiver's status
 func (r *receiver) Status() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	return r.status
 }
@@ -0,0 +1,204 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// senderService record Sender of every request
+type senderService struct {
+	lock    sync.Mutex
+	senders []Sender
+}
+
+func (s *senderService) IsBackground() bool {
+	return false
+}
+
+func (s *senderService) OnMessage(req Request) error {
+	return nil
+}
+
+func (s *senderService) OnCall(req Request, resp Response) error {
+	s.lock.Lock()
+	s.senders = append(s.senders, req.GetSender())
+	s.lock.Unlock()
+	return resp.SendString("ok")
+}
+
+func TestRequestsShareSender(t *testing.T) {
+	broker := newFakeBroker(t)
+	server := NewServer(broker.Config())
+	service := &senderService{}
+	server.RegisterService("test", "sender", service)
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := sender.CallContext(ctx, "Node1.test.sender", []byte("request"))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	if len(service.senders) != 3 {
+		t.Fatalf("service is called %d times, want 3", len(service.senders))
+	}
+	for _, s := range service.senders {
+		if s != (sharedSender{server.sender}) {
+			t.Fatal("request does not use the shared Sender of Server")
+		}
+	}
+	// Shared Sender is connected lazily, it is not connected by requests
+	// which do not use it
+	if connections := broker.Connections(); connections != 2 {
+		t.Fatalf("%d connections, want 2", connections)
+	}
+}
+
+// relayService close Sender of request after sending message to sink, like
+// handlers which treat it as their own Sender
+type relayService struct {
+	messages int32
+}
+
+func (s *relayService) IsBackground() bool {
+	return false
+}
+
+func (s *relayService) OnMessage(req Request) error {
+	atomic.AddInt32(&s.messages, 1)
+	return nil
+}
+
+func (s *relayService) OnCall(req Request, resp Response) error {
+	sender := req.GetSender()
+	defer sender.Close()
+	if err := sender.Send("Node1.test.sink", req.GetMessage()); err != nil {
+		return err
+	}
+	return resp.SendString("ok")
+}
+
+func TestRequestCloseSharedSender(t *testing.T) {
+	broker := newFakeBroker(t)
+	server := NewServer(broker.Config())
+	service := &relayService{}
+	server.RegisterService("test", "relay", service)
+	server.RegisterService("test", "sink", service)
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+	// Sender closed by first request is still usable by next one
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := sender.CallContext(ctx, "Node1.test.relay", []byte("request"))
+		cancel()
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	waitFor(t, 5*time.Second, "messages relayed", func() bool {
+		return atomic.LoadInt32(&service.messages) == 2
+	})
+}
+
+// startShutdownServer start server with a blockService and make a call which
+// blocks in service, call result is sent to returned channel
+func startShutdownServer(t *testing.T, broker *fakeBroker) (*Server, *blockService, chan error) {
+	server := NewServer(broker.Config())
+	service := newBlockService()
+	server.RegisterService("test", "block", service, WithConcurrency(1))
+	server.Start()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	sender := NewSender(broker.Config())
+	t.Cleanup(func() { sender.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := sender.CallContext(ctx, "Node1.test.block", []byte("request"))
+		errs <- err
+	}()
+	<-service.started
+	return server, service, errs
+}
+
+func TestShutdownWaitRunningService(t *testing.T) {
+	broker := newFakeBroker(t)
+	server, service, errs := startShutdownServer(t, broker)
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "consumer canceled", func() bool {
+		return broker.Consumers("Node1") == 0
+	})
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while service is running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Connection is kept open for running service to reply
+	close(service.release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "server connection closed", func() bool {
+		return broker.Connections() == 1
+	})
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	broker := newFakeBroker(t)
+	server, service, _ := startShutdownServer(t, broker)
+	defer close(service.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	// Workers are stopped although service is still running
+	worker := server.workers["test.block"]
+	select {
+	case <-worker.quit:
+	default:
+		t.Fatal("worker is not stopped")
+	}
+	if err := worker.PushJob(&job{}); err != ErrServerStopped {
+		t.Fatalf("got error %v, want %v", err, ErrServerStopped)
+	}
+	waitFor(t, 5*time.Second, "server connection closed", func() bool {
+		return broker.Connections() == 1
+	})
+}
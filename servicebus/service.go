@@ -1,7 +1,10 @@
 package servicebus
 
 import (
+	"context"
 	"errors"
+	"strconv"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -15,7 +18,8 @@ var (
 	ErrAlreadySend = errors.New("Already send response")
 )
 
-// Sender is message sender
+// Sender is message sender.
+// Senders created by NewSender are safe for concurrent use by multiple goroutines.
 type Sender interface {
 	// Ping a target
 	Ping(target string, timeout int) bool
@@ -23,6 +27,13 @@ type Sender interface {
 	Call(target string, message []byte, timeout int) ([]byte, error)
 	// Send just send message to target and not wait response
 	Send(target string, message []byte) error
+	// PingContext ping a target until ctx is done
+	PingContext(ctx context.Context, target string) bool
+	// CallContext make RPC request to target and wait response until ctx is done.
+	// If ctx is canceled or reaches its deadline, ctx.Err() is returned
+	CallContext(ctx context.Context, target string, message []byte, opts ...CallOption) ([]byte, error)
+	// SendContext just send message to target, return ctx.Err() if ctx is already done
+	SendContext(ctx context.Context, target string, message []byte, opts ...CallOption) error
 	// Close close Sender connection
 	Close() error
 }
@@ -31,8 +42,28 @@ type Sender interface {
 type Request interface {
 	// GetMessage get message sender sent
 	GetMessage() []byte
-	// GetSender return a smart sender for user to send message to other target
+	// GetSender return Server's shared Sender for user to send message to
+	// other target. Its Close does nothing, it is closed by Server.Shutdown
 	GetSender() Sender
+	// Context return context of request, middleware can set values in it
+	Context() context.Context
+	// Header return header set by sender, empty string if not set
+	Header(name string) string
+	// Headers return all headers set by sender
+	Headers() map[string]string
+	// Caller return NodeName of sender
+	Caller() string
+	// MessageID return AMQP MessageId, or envelope ID if sender did not
+	// set MessageId, such as py-servicebus
+	MessageID() string
+	// CorrelationID return AMQP correlation ID, it is empty for Send
+	CorrelationID() string
+	// Timestamp return time message was sent, zero if sender did not set it
+	Timestamp() time.Time
+	// DeliveryCount return times message was delivered, 1 for first
+	// delivery. If broker does not count deliveries, redelivered message
+	// returns 2.
+	DeliveryCount() int
 }
 
 // Response works for Service to send RPC response
@@ -41,16 +72,95 @@ type Response interface {
 	Send(message []byte) error
 	// SendString send string message to RPC caller
 	SendString(message string) error
+	// SetHeader set header of response, it must be called before Send
+	SetHeader(name, value string)
 }
 
 // Service is a service interface
 type Service interface {
 	// IsBackground if return true it will run service in new goroutine
 	IsBackground() bool
-	// OnMessage when Message received this method will be called
-	OnMessage(req Request)
-	// OnCall when RPC received this method will be called
-	OnCall(req Request, resp Response)
+	// OnMessage when Message received this method will be called.
+	// Returned error make message rejected or requeued, see AckMode
+	OnMessage(req Request) error
+	// OnCall when RPC received this method will be called.
+	// If it returns error before response is sent, the error is replied to
+	// caller and Sender.Call returns it as *RemoteError
+	OnCall(req Request, resp Response) error
+}
+
+// OverflowPolicy decide what to do when service's job queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock wait until queue has room, receiving is paused
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject reply ErrCodeBusy error to RPC caller, messages are dropped
+	OverflowReject
+	// OverflowNack reject message and requeue it for redelivery
+	OverflowNack
+)
+
+const defaultQueueDepth = 2
+
+// ServiceOption configure how Server runs a Service
+type ServiceOption func(*serviceOptions)
+
+type serviceOptions struct {
+	defaultResponse []byte
+	concurrency     int
+	queueDepth      int
+	overflow        OverflowPolicy
+	policy          *Policy
+	payloadCodec    PayloadCodec
+}
+
+func newServiceOptions(options []ServiceOption) *serviceOptions {
+	opts := &serviceOptions{
+		queueDepth: defaultQueueDepth,
+	}
+	for _, option := range options {
+		option(opts)
+	}
+	return opts
+}
+
+// WithDefaultResponse set response sent to caller when OnCall returns
+// without sending response. Without it an ErrCodeEmptyResponse error is sent.
+func WithDefaultResponse(message []byte) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.defaultResponse = message
+	}
+}
+
+// WithConcurrency run service by n goroutines, n less than 1 is treated as
+// 1. Without it service runs serially, or one goroutine per job if
+// IsBackground returns true.
+func WithConcurrency(n int) ServiceOption {
+	if n < 1 {
+		n = 1
+	}
+	return func(opts *serviceOptions) {
+		opts.concurrency = n
+	}
+}
+
+// WithQueueDepth set size of service's job queue, default is 2. Negative n
+// is treated as 0, which means jobs are handed to service directly.
+func WithQueueDepth(n int) ServiceOption {
+	if n < 0 {
+		n = 0
+	}
+	return func(opts *serviceOptions) {
+		opts.queueDepth = n
+	}
+}
+
+// WithOverflow set what to do when service's job queue is full
+func WithOverflow(policy OverflowPolicy) ServiceOption {
+	return func(opts *serviceOptions) {
+		opts.overflow = policy
+	}
 }
 
 // SimpleService is simple implements for Service interface
@@ -62,27 +172,88 @@ func (s *SimpleService) IsBackground() bool {
 	return s.Background
 }
 
-func (s *SimpleService) OnMessage(req Request) {
+func (s *SimpleService) OnMessage(req Request) error {
 	// Do nothing
+	return nil
 }
 
-func (s *SimpleService) OnCall(req Request, resp Response) {
+func (s *SimpleService) OnCall(req Request, resp Response) error {
 	// Do nothing, just send "0" response
-	resp.SendString("0")
+	return resp.SendString("0")
 }
 
 // amqpRequest is Request interface implement
 type amqpRequest struct {
-	driver *AMQPDriver
-	msg    []byte
+	driver   *AMQPDriver
+	sender   Sender
+	delivery amqp.Delivery
+	event    *EventMessage
+	ctx      context.Context
+}
+
+func (r *amqpRequest) Context() context.Context {
+	return r.ctx
 }
 
 func (r *amqpRequest) GetMessage() []byte {
-	return r.msg
+	return r.event.Params
 }
 
 func (r *amqpRequest) GetSender() Sender {
-	return NewSender(r.driver.config)
+	return r.sender
+}
+
+func (r *amqpRequest) Header(name string) string {
+	return r.event.Headers[name]
+}
+
+func (r *amqpRequest) Headers() map[string]string {
+	ret := make(map[string]string, len(r.event.Headers))
+	for name, value := range r.event.Headers {
+		ret[name] = value
+	}
+	return ret
+}
+
+func (r *amqpRequest) Caller() string {
+	return r.event.Caller
+}
+
+func (r *amqpRequest) MessageID() string {
+	if r.delivery.MessageId != "" {
+		return r.delivery.MessageId
+	}
+	return strconv.Itoa(r.event.ID)
+}
+
+func (r *amqpRequest) CorrelationID() string {
+	return r.delivery.CorrelationId
+}
+
+func (r *amqpRequest) Timestamp() time.Time {
+	if !r.delivery.Timestamp.IsZero() {
+		return r.delivery.Timestamp
+	}
+	if r.event.Timestamp != 0 {
+		return time.Unix(r.event.Timestamp, 0)
+	}
+	return time.Time{}
+}
+
+func (r *amqpRequest) DeliveryCount() int {
+	// x-delivery-count is set by quorum queues for redelivered message
+	switch count := r.delivery.Headers["x-delivery-count"].(type) {
+	case int16:
+		return int(count) + 1
+	case int32:
+		return int(count) + 1
+	case int64:
+		return int(count) + 1
+	}
+	if r.delivery.Redelivered {
+		return 2
+	}
+	return 1
 }
 
 // amqpResponse is Response interface implement
@@ -90,27 +261,52 @@ type amqpResponse struct {
 	driver   *AMQPDriver
 	delivery amqp.Delivery
 	event    *EventMessage
+	headers  map[string]string
 	sended   bool
 }
 
+func (r *amqpResponse) SetHeader(name, value string) {
+	if r.headers == nil {
+		r.headers = make(map[string]string)
+	}
+	r.headers[name] = value
+}
+
 func (r *amqpResponse) SendString(msg string) error {
 	return r.Send([]byte(msg))
 }
 
 func (r *amqpResponse) Send(msg []byte) error {
+	return r.reply(createEventResponse(r.event, msg))
+}
+
+// sendError send error response to RPC caller
+func (r *amqpResponse) sendError(rerr *RemoteError) error {
+	return r.reply(createErrorResponse(r.event, rerr))
+}
+
+func (r *amqpResponse) reply(replyMsg *EventResponse) error {
 	if r.sended {
 		return ErrAlreadySend
 	}
-	replyMsg := createEventResponse(r.event, msg)
-	err := r.driver.channel.Publish(
+	replyMsg.Headers = r.headers
+	// Reply is encoded by Codec of request
+	codec, err := codecFor(r.delivery.ContentType)
+	if err != nil {
+		return err
+	}
+	body, err := codec.EncodeResponse(replyMsg)
+	if err != nil {
+		return err
+	}
+	err = r.driver.Publish(
 		"",                 // exchange
 		r.delivery.ReplyTo, // routing key
-		false,              // mandatory
-		false,              // immediate
 		amqp.Publishing{
-			ContentType:   "text/plain",
+			ContentType:   codec.ContentType(),
+			MessageId:     newUUID(),
 			CorrelationId: r.delivery.CorrelationId,
-			Body:          replyMsg.toXML(),
+			Body:          body,
 		},
 	)
 	if err == nil {
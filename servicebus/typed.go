@@ -0,0 +1,141 @@
+package servicebus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	ErrInvalidPayload = errors.New("Invalid payload")
+)
+
+// PayloadCodec marshal typed requests and responses to message payload
+type PayloadCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONPayloadCodec return PayloadCodec of JSON, it is default of typed
+// services and calls
+func JSONPayloadCodec() PayloadCodec {
+	return jsonPayloadCodec{}
+}
+
+type jsonPayloadCodec struct{}
+
+func (jsonPayloadCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonPayloadCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MsgpackPayloadCodec return PayloadCodec of MessagePack
+func MsgpackPayloadCodec() PayloadCodec {
+	return msgpackPayloadCodec{}
+}
+
+type msgpackPayloadCodec struct{}
+
+func (msgpackPayloadCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackPayloadCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// WithPayloadCodec set PayloadCodec of service registered by
+// RegisterTypedService, default is JSONPayloadCodec
+func WithPayloadCodec(codec PayloadCodec) ServiceOption {
+	return func(o *serviceOptions) {
+		o.payloadCodec = codec
+	}
+}
+
+// UsePayloadCodec set PayloadCodec of CallTyped, default is JSONPayloadCodec
+func UsePayloadCodec(codec PayloadCodec) CallOption {
+	return func(call *ClientCall) {
+		call.payloadCodec = codec
+	}
+}
+
+// RegisterTypedService register fn as service. Request payload is
+// unmarshaled to Req and returned Resp is marshaled as response. Request
+// can not be unmarshaled is replied with ErrCodeBadRequest. For messages
+// sent by Send, returned Resp is dropped.
+func RegisterTypedService[Req, Resp any](server *Server, module, service string, fn func(ctx context.Context, req Req) (Resp, error), options ...ServiceOption) {
+	codec := newServiceOptions(options).payloadCodec
+	if codec == nil {
+		codec = JSONPayloadCodec()
+	}
+	instance := &typedService[Req, Resp]{
+		fn:    fn,
+		codec: codec,
+	}
+	server.RegisterService(module, service, instance, options...)
+}
+
+// typedService is Service implement of RegisterTypedService
+type typedService[Req, Resp any] struct {
+	fn    func(ctx context.Context, req Req) (Resp, error)
+	codec PayloadCodec
+}
+
+func (s *typedService[Req, Resp]) IsBackground() bool {
+	return false
+}
+
+func (s *typedService[Req, Resp]) OnMessage(req Request) error {
+	_, err := s.handle(req)
+	return err
+}
+
+func (s *typedService[Req, Resp]) OnCall(req Request, resp Response) error {
+	ret, err := s.handle(req)
+	if err != nil {
+		return err
+	}
+	data, err := s.codec.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return resp.Send(data)
+}
+
+func (s *typedService[Req, Resp]) handle(req Request) (Resp, error) {
+	var args Req
+	if err := s.codec.Unmarshal(req.GetMessage(), &args); err != nil {
+		var empty Resp
+		return empty, NewRemoteError(ErrCodeBadRequest, fmt.Sprintf("%v: %v", ErrInvalidPayload, err))
+	}
+	return s.fn(req.Context(), args)
+}
+
+// CallTyped marshal req and call target, then unmarshal response to Resp.
+// Response can not be unmarshaled returns error wrapping ErrInvalidPayload,
+// errors replied by service are *RemoteError.
+func CallTyped[Req, Resp any](ctx context.Context, sender Sender, target string, req Req, opts ...CallOption) (Resp, error) {
+	var ret Resp
+	codec := newClientCall(KindCall, target, nil, opts).payloadCodec
+	if codec == nil {
+		codec = JSONPayloadCodec()
+	}
+	data, err := codec.Marshal(req)
+	if err != nil {
+		return ret, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	resp, err := sender.CallContext(ctx, target, data, opts...)
+	if err != nil {
+		return ret, err
+	}
+	if err := codec.Unmarshal(resp, &ret); err != nil {
+		return ret, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return ret, nil
+}
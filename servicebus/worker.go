@@ -1,7 +1,10 @@
 package servicebus
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/streadway/amqp"
 )
@@ -16,38 +19,65 @@ type job struct {
 	Message amqp.Delivery
 	// Event is decoded AMQP message
 	Event *EventMessage
+	// KeyID is ID of key which signed the message
+	KeyID string
 }
 
 // worker is Service runner for service bus
 type worker struct {
 	name    string
 	service Service
+	options *serviceOptions
+	handler Handler
+	// sender is Server's shared Sender returned by Request.GetSender
+	sender  Sender
 	queue   chan *job
+	lock    sync.Mutex
+	stopped bool
+	// pending count jobs pushed but not finished
+	pending sync.WaitGroup
+	// quit is closed when worker stops running jobs
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 // newWorker create new worker to execute service
-func newWorker(name string, srv Service) *worker {
+func newWorker(name string, srv Service, options *serviceOptions) *worker {
 	return &worker{
 		name:    name,
 		service: srv,
-		queue:   make(chan *job, 2),
+		options: options,
+		queue:   make(chan *job, options.queueDepth),
+		quit:    make(chan struct{}),
 	}
 }
 
-func (w *worker) processMessage(jobj *job) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Service %s (recover): %v", w.name, r)
-		}
-	}()
+// processMessage execute job, it reports whether a RPC response was sent
+func (w *worker) processMessage(jobj *job) (bool, error) {
 	req := &amqpRequest{
-		driver: jobj.Driver,
-		msg:    jobj.Event.Params,
+		driver:   jobj.Driver,
+		sender:   w.sender,
+		delivery: jobj.Message,
+		event:    jobj.Event,
+		ctx:      context.Background(),
+	}
+	inv := &Invocation{
+		Context: req.ctx,
+		Type:    jobj.Type,
+		Service: w.name,
+		Event:   jobj.Event,
+		KeyID:   jobj.KeyID,
+		Request: req,
 	}
+	var err error
+	replied := false
 	switch jobj.Type {
 	case MessageType:
-		log.Println("Process Message Service:", w.name)
-		w.service.OnMessage(req)
+		log.Println("Process Message Service:", w.name, "Key:", jobj.KeyID)
+		err = w.invoke(inv)
+		if err != nil {
+			log.Printf("Service %s: %v", w.name, err)
+		}
 		log.Println("Process Message Service:", w.name, "Done")
 	case RPCType:
 		resp := &amqpResponse{
@@ -56,29 +86,189 @@ func (w *worker) processMessage(jobj *job) {
 			event:    jobj.Event,
 			sended:   false,
 		}
-		log.Println("Process RPC Service:", w.name)
-		w.service.OnCall(req, resp)
+		inv.Response = resp
+		log.Println("Process RPC Service:", w.name, "Key:", jobj.KeyID)
+		err = w.invoke(inv)
+		if err != nil {
+			log.Printf("Service %s: %v", w.name, err)
+			if !resp.sended {
+				if serr := resp.sendError(toRemoteError(err)); serr != nil {
+					log.Printf("Service %s send error response: %v", w.name, serr)
+				}
+			}
+		} else if !resp.sended {
+			w.sendDefaultResponse(resp)
+		}
+		replied = resp.sended
 		log.Println("Process RPC Service:", w.name, "Done")
 	}
+	return replied, err
+}
+
+// call is the innermost Handler, it calls Service methods
+func (w *worker) call(inv *Invocation) error {
+	if req, ok := inv.Request.(*amqpRequest); ok {
+		req.ctx = inv.Context
+	}
+	if inv.Type == RPCType {
+		return w.service.OnCall(inv.Request, inv.Response)
+	}
+	return w.service.OnMessage(inv.Request)
+}
+
+// sendDefaultResponse reply caller when service returned without response
+func (w *worker) sendDefaultResponse(resp *amqpResponse) {
+	var err error
+	if w.options.defaultResponse != nil {
+		err = resp.Send(w.options.defaultResponse)
+	} else {
+		log.Printf("Service %s: returned without sending response", w.name)
+		err = resp.sendError(NewRemoteError(ErrCodeEmptyResponse, "Service returned without sending response"))
+	}
+	if err != nil {
+		log.Printf("Service %s send default response: %v", w.name, err)
+	}
+}
+
+// invoke run invocation through middlewares and service, panic is
+// recovered and returned as error
+func (w *worker) invoke(inv *Invocation) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Service %s (recover): %v", w.name, r)
+			err = NewRemoteError(ErrCodePanic, fmt.Sprintf("%v", r))
+		}
+	}()
+	return w.handler(inv)
+}
+
+// settle acknowledge job's message by AckMode after job processed. RPC
+// request already replied is never requeued, because caller has got the
+// response and requeued request would run again without a caller.
+func (w *worker) settle(jobj *job, replied bool, err error) {
+	switch jobj.Driver.config.AckMode {
+	case AckAfterSuccess:
+		if err == nil {
+			jobj.Message.Ack(false)
+		} else {
+			jobj.Message.Nack(false, false)
+		}
+	case AckRequeueOnFailure:
+		if err == nil {
+			jobj.Message.Ack(false)
+		} else {
+			jobj.Message.Nack(false, !replied)
+		}
+	}
+}
+
+// process execute job and mark it finished
+func (w *worker) process(jobj *job) {
+	defer w.pending.Done()
+	replied, err := w.processMessage(jobj)
+	w.settle(jobj, replied, err)
 }
 
 // Run execute worker's Service related methods
 func (w *worker) Run() {
-	for jobj := range w.queue {
-		if w.service.IsBackground() {
-			go w.processMessage(jobj)
-		} else {
-			w.processMessage(jobj)
+	for {
+		select {
+		case jobj := <-w.queue:
+			if w.service.IsBackground() {
+				go w.process(jobj)
+			} else {
+				w.process(jobj)
+			}
+		case <-w.quit:
+			return
 		}
 	}
 }
 
-// Start start worker
-func (w *worker) Start() {
+// runPool execute jobs one by one, worker starts concurrency of them
+func (w *worker) runPool() {
+	for {
+		select {
+		case jobj := <-w.queue:
+			w.process(jobj)
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// Start start worker, service calls are wrapped by middlewares
+func (w *worker) Start(middlewares []Middleware) {
+	w.handler = chainMiddlewares(middlewares, w.call)
+	if w.options.concurrency > 0 {
+		for i := 0; i < w.options.concurrency; i++ {
+			go w.runPool()
+		}
+		return
+	}
 	go w.Run()
 }
 
-// PushJob push a job to worker's queue
-func (w *worker) PushJob(jobj *job) {
-	w.queue <- jobj
+// Stop stop accepting new jobs and wait all pushed jobs finished
+func (w *worker) Stop() {
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return
+	}
+	w.stopped = true
+	w.lock.Unlock()
+	w.pending.Wait()
+	w.quitOnce.Do(func() { close(w.quit) })
+}
+
+// Abort stop accepting new jobs and drop queued jobs without waiting
+// running ones. Dropped jobs are not acknowledged, broker requeues them when
+// connection is closed.
+func (w *worker) Abort() {
+	w.lock.Lock()
+	w.stopped = true
+	w.lock.Unlock()
+	w.quitOnce.Do(func() { close(w.quit) })
+	for {
+		select {
+		case <-w.queue:
+			w.pending.Done()
+		default:
+			return
+		}
+	}
+}
+
+// PushJob push a job to worker's queue. If queue is full and overflow
+// policy is not OverflowBlock, ErrServiceBusy or errServiceBusyRequeue
+// is returned.
+func (w *worker) PushJob(jobj *job) error {
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return ErrServerStopped
+	}
+	w.pending.Add(1)
+	w.lock.Unlock()
+	if w.options.overflow == OverflowBlock {
+		select {
+		case w.queue <- jobj:
+			return nil
+		case <-w.quit:
+			w.pending.Done()
+			return ErrServerStopped
+		}
+	}
+	select {
+	case w.queue <- jobj:
+		return nil
+	default:
+		w.pending.Done()
+		log.Printf("Service %s: queue is full", w.name)
+		if w.options.overflow == OverflowNack {
+			return errServiceBusyRequeue
+		}
+		return ErrServiceBusy
+	}
 }
@@ -0,0 +1,240 @@
+package servicebus
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failService fail every call, and fail messages until they are redelivered
+type failService struct {
+	calls    int32
+	messages int32
+}
+
+func (s *failService) IsBackground() bool {
+	return false
+}
+
+func (s *failService) OnMessage(req Request) error {
+	if atomic.AddInt32(&s.messages, 1) == 1 {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (s *failService) OnCall(req Request, resp Response) error {
+	atomic.AddInt32(&s.calls, 1)
+	return errors.New("failed")
+}
+
+func TestRequeueOnFailure(t *testing.T) {
+	testRequeueOnFailure(t, AuthToken)
+}
+
+// Requeued message has a nonce already seen by server, it must not be
+// dropped as replayed
+func TestRequeueOnFailureHMAC(t *testing.T) {
+	testRequeueOnFailure(t, AuthHMAC)
+}
+
+func testRequeueOnFailure(t *testing.T, mode AuthMode) {
+	broker := newFakeBroker(t)
+	config := broker.Config()
+	config.AckMode = AckRequeueOnFailure
+	config.AuthMode = mode
+	server := NewServer(config)
+	service := &failService{}
+	server.RegisterService("test", "fail", service)
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	sender := NewSender(config)
+	defer sender.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := sender.CallContext(ctx, "Node1.test.fail", []byte("request"))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("got error %v, want RemoteError", err)
+	}
+	// Failed message is requeued and succeeds on redelivery
+	if err := sender.Send("Node1.test.fail", []byte("message")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "message redelivered", func() bool {
+		return atomic.LoadInt32(&service.messages) == 2
+	})
+	// Replied call is not requeued, it would run again without a caller
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Fatalf("call is processed %d times, want 1", calls)
+	}
+	if ready := broker.Ready("Node1"); ready != 0 {
+		t.Fatalf("%d messages left in queue", ready)
+	}
+}
+
+// blockService block every call and message until release is closed
+type blockService struct {
+	started  chan struct{}
+	release  chan struct{}
+	calls    int32
+	messages int32
+}
+
+func newBlockService() *blockService {
+	return &blockService{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *blockService) IsBackground() bool {
+	return false
+}
+
+func (s *blockService) OnMessage(req Request) error {
+	s.started <- struct{}{}
+	<-s.release
+	atomic.AddInt32(&s.messages, 1)
+	return nil
+}
+
+func (s *blockService) OnCall(req Request, resp Response) error {
+	s.started <- struct{}{}
+	<-s.release
+	atomic.AddInt32(&s.calls, 1)
+	return resp.SendString("ok")
+}
+
+// startBlockServer start server with a blockService which runs one job at a
+// time without queue
+func startBlockServer(t *testing.T, broker *fakeBroker, overflow OverflowPolicy) *blockService {
+	server := NewServer(broker.Config())
+	service := newBlockService()
+	server.RegisterService("test", "block", service, WithConcurrency(1), WithQueueDepth(0), WithOverflow(overflow))
+	server.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	return service
+}
+
+func TestOverflowReject(t *testing.T) {
+	broker := newFakeBroker(t)
+	service := startBlockServer(t, broker, OverflowReject)
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sender.CallContext(ctx, "Node1.test.block", []byte("first"))
+		errs <- err
+	}()
+	<-service.started
+	// Service is busy and has no queue, second call is rejected at once
+	_, err := sender.CallContext(ctx, "Node1.test.block", []byte("second"))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != ErrCodeBusy {
+		t.Fatalf("got error %v, want RemoteError %s", err, ErrCodeBusy)
+	}
+	close(service.release)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Fatalf("service is called %d times, want 1", calls)
+	}
+}
+
+func TestOverflowNack(t *testing.T) {
+	broker := newFakeBroker(t)
+	service := startBlockServer(t, broker, OverflowNack)
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+
+	if err := sender.Send("Node1.test.block", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	<-service.started
+	if err := sender.Send("Node1.test.block", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	// Second message is requeued while service is busy, and processed
+	// after service is released
+	waitFor(t, 5*time.Second, "message requeued", func() bool {
+		return broker.Requeued() > 0
+	})
+	close(service.release)
+	waitFor(t, 5*time.Second, "messages processed", func() bool {
+		return atomic.LoadInt32(&service.messages) == 2
+	})
+	if ready := broker.Ready("Node1"); ready != 0 {
+		t.Fatalf("%d messages left in queue", ready)
+	}
+	if dropped := broker.Dropped(); dropped != 0 {
+		t.Fatalf("%d messages dropped, want 0", dropped)
+	}
+}
+
+// silentService return from OnCall without sending response
+type silentService struct{}
+
+func (silentService) IsBackground() bool {
+	return false
+}
+
+func (silentService) OnMessage(req Request) error {
+	return nil
+}
+
+func (silentService) OnCall(req Request, resp Response) error {
+	return nil
+}
+
+func TestDefaultResponse(t *testing.T) {
+	broker := newFakeBroker(t)
+	server := NewServer(broker.Config())
+	server.RegisterService("test", "silent", silentService{})
+	server.RegisterService("test", "default", silentService{}, WithDefaultResponse([]byte("default")))
+	server.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	waitFor(t, 5*time.Second, "server consuming", func() bool {
+		return broker.Consumers("Node1") == 1
+	})
+	sender := NewSender(broker.Config())
+	defer sender.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Caller gets an error instead of waiting until timeout
+	_, err := sender.CallContext(ctx, "Node1.test.silent", []byte("request"))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != ErrCodeEmptyResponse {
+		t.Fatalf("got error %v, want RemoteError %s", err, ErrCodeEmptyResponse)
+	}
+	ret, err := sender.CallContext(ctx, "Node1.test.default", []byte("request"))
+	if err != nil || string(ret) != "default" {
+		t.Fatalf("got %q, %v, want default response", ret, err)
+	}
+}